@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// permissions carried by client tokens. admin implies publish and subscribe
+// and unlocks the admin endpoints; metrics only reads /_metrics, so a
+// scraper's token cannot touch channels or the cluster.
+const (
+	permPublish   = "publish"
+	permSubscribe = "subscribe"
+	permAdmin     = "admin"
+	permMetrics   = "metrics"
+)
+
+const authTokenMaxTTL = 365 * 24 * time.Hour
+
+var errUnauthorized = errors.New("unauthorized")
+
+// principal is what a client token grants: permissions on the channels
+// matching any of Channels. It is also the claim set of a signed token.
+type principal struct {
+	Sub      string   `json:"sub,omitempty"`
+	Perms    []string `json:"perms"`
+	Channels []string `json:"channels,omitempty"` // patterns; empty means "/**"
+	Exp      int64    `json:"exp,omitempty"`      // unix seconds
+
+	open bool // auth disabled: everything is allowed
+}
+
+// authConfig holds the static tokens from AUTH_TOKENS and the AUTH_SECRET
+// that signed tokens are checked against.
+type authConfig struct {
+	static map[string]*principal
+	secret []byte
+}
+
+// authFromEnv parses AUTH_TOKENS, entries "secret=perm+perm@pattern,pattern"
+// separated by ";", and AUTH_SECRET. It returns nil when neither is set or
+// AUTH_DISABLED is, which leaves every channel open.
+func authFromEnv() (*authConfig, error) {
+	if boolEnv("AUTH_DISABLED") {
+		if os.Getenv("AUTH_TOKENS") != "" || os.Getenv("AUTH_SECRET") != "" {
+			return nil, errors.New("AUTH_DISABLED conflicts with AUTH_TOKENS and AUTH_SECRET")
+		}
+		return nil, nil
+	}
+	a := &authConfig{static: make(map[string]*principal), secret: []byte(os.Getenv("AUTH_SECRET"))}
+	for _, entry := range strings.Split(os.Getenv("AUTH_TOKENS"), ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		tok, grant, ok := strings.Cut(entry, "=")
+		if !ok || tok == "" {
+			return nil, fmt.Errorf("invalid AUTH_TOKENS entry: want secret=perms[@channels]")
+		}
+		perms, chans, _ := strings.Cut(grant, "@")
+		p := &principal{Sub: "static:" + tokenHash(tok)}
+		for _, perm := range strings.Split(perms, "+") {
+			if !validPerm(perm) {
+				return nil, fmt.Errorf("invalid AUTH_TOKENS permission %q", perm)
+			}
+			p.Perms = append(p.Perms, perm)
+		}
+		for _, ch := range strings.Split(chans, ",") {
+			if ch = strings.TrimSpace(ch); ch != "" {
+				p.Channels = append(p.Channels, "/"+strings.Trim(ch, "/"))
+			}
+		}
+		a.static[tok] = p
+	}
+	if len(a.static) == 0 && len(a.secret) == 0 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+func validPerm(p string) bool {
+	return p == permPublish || p == permSubscribe || p == permAdmin || p == permMetrics
+}
+
+// can reports whether p may perform perm on channel, which may be a pattern.
+func (p *principal) can(perm, channel string) bool {
+	if p.open {
+		return true
+	}
+	allowed := false
+	for _, have := range p.Perms {
+		allowed = allowed || have == perm || have == permAdmin
+	}
+	if !allowed {
+		return false
+	}
+	if len(p.Channels) == 0 {
+		return true
+	}
+	for _, pat := range p.Channels {
+		if coversChannel(pat, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientToken is the bearer token, or ?token= on WebSocket upgrades, which
+// browsers cannot add headers to.
+func clientToken(r *http.Request) string {
+	if tok := bearerToken(r); tok != "" {
+		return tok
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return ""
+	}
+	return r.URL.Query().Get("token")
+}
+
+// redactToken masks ?token= in the request URI so the access log never
+// records it.
+func redactToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query(); q.Has("token") {
+			q.Set("token", "redacted")
+			r = r.WithContext(r.Context())
+			r.RequestURI = r.URL.EscapedPath() + "?" + q.Encode()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate resolves the request's token to a principal. With auth
+// disabled every request gets an open principal.
+func (s *Server) authenticate(r *http.Request) (*principal, error) {
+	auth := s.auth.Load()
+	if auth == nil {
+		return &principal{open: true}, nil
+	}
+	tok := clientToken(r)
+	if tok == "" {
+		return nil, errUnauthorized
+	}
+	for secret, p := range auth.static {
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(secret)) == 1 {
+			return p, nil
+		}
+	}
+	return auth.verify(tok)
+}
+
+// authorize authenticates r and checks perm on channel, writing 401 or 403
+// and returning nil when the request may not proceed.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, perm, channel string) *principal {
+	p, err := s.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	if !p.can(perm, channel) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil
+	}
+	return p
+}
+
+// signed tokens: base64url(claims JSON) "." base64url(HMAC-SHA256(AUTH_SECRET, first part)).
+func (a *authConfig) sign(p *principal) string {
+	claims, _ := json.Marshal(p)
+	body := base64.RawURLEncoding.EncodeToString(claims)
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte(body))
+	return body + "." + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (a *authConfig) verify(tok string) (*principal, error) {
+	if len(a.secret) == 0 {
+		return nil, errUnauthorized
+	}
+	body, sig, ok := strings.Cut(tok, ".")
+	if !ok {
+		return nil, errUnauthorized
+	}
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte(body))
+	want := base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+	if !hmac.Equal([]byte(want), []byte(sig)) {
+		return nil, errUnauthorized
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, errUnauthorized
+	}
+	var p principal
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, errUnauthorized
+	}
+	if p.Exp != 0 && time.Now().Unix() > p.Exp {
+		return nil, errUnauthorized
+	}
+	if p.Sub == "" {
+		p.Sub = "signed:" + tokenHash(tok)
+	}
+	return &p, nil
+}
+
+// tokenHash names a token in limits and logs without revealing it.
+func tokenHash(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:6])
+}
+
+// identity keys per-token limits and quotas; it is empty with auth disabled.
+func (p *principal) identity() string {
+	if p.open {
+		return ""
+	}
+	return p.Sub
+}
+
+// adminView answers 401 for views that list every channel and peer, unless
+// auth is off or the caller is an admin.
+func (s *Server) adminView(w http.ResponseWriter, r *http.Request) bool {
+	if s.auth.Load() == nil || s.isAdmin(r) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// metricsView is adminView for /_metrics, also letting in tokens that carry
+// the metrics permission.
+func (s *Server) metricsView(w http.ResponseWriter, r *http.Request) bool {
+	if s.auth.Load() == nil || s.isAdmin(r) {
+		return true
+	}
+	if p, err := s.authenticate(r); err == nil && slices.Contains(p.Perms, permMetrics) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// mintAuthToken serves POST /_auth/tokens for admins:
+//
+//	{"sub":"ci","perms":["publish"],"channels":["/builds/**"],"ttl":"720h"}
+func (s *Server) mintAuthToken(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	auth := s.auth.Load()
+	if auth == nil || len(auth.secret) == 0 {
+		http.Error(w, "AUTH_SECRET not configured", http.StatusNotImplemented)
+		return
+	}
+	var req struct {
+		principal
+		TTL string `json:"ttl"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	p := req.principal
+	if len(p.Perms) == 0 {
+		http.Error(w, "perms required", http.StatusBadRequest)
+		return
+	}
+	for _, perm := range p.Perms {
+		if !validPerm(perm) {
+			http.Error(w, "invalid permission "+perm, http.StatusBadRequest)
+			return
+		}
+	}
+	for i, ch := range p.Channels {
+		p.Channels[i] = "/" + strings.Trim(ch, "/")
+	}
+	resp := map[string]any{}
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 || d > authTokenMaxTTL {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		exp := time.Now().Add(d)
+		p.Exp = exp.Unix()
+		resp["expiresAt"] = exp.UTC().Format(time.RFC3339)
+	}
+	resp["token"] = auth.sign(&p)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
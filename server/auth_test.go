@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrincipalCan(t *testing.T) {
+	cases := []struct {
+		perms, channels []string
+		perm, channel   string
+		want            bool
+	}{
+		{[]string{permPublish}, nil, permPublish, "/anything", true},
+		{[]string{permPublish}, nil, permSubscribe, "/anything", false},
+		{[]string{permAdmin}, nil, permSubscribe, "/anything", true},
+		{[]string{permAdmin}, []string{"/logs/**"}, permPublish, "/audit/x", false},
+		{[]string{permMetrics}, nil, permSubscribe, "/logs/a", false},
+		{[]string{permSubscribe}, []string{"/logs/a"}, permSubscribe, "/logs/a", true},
+		{[]string{permSubscribe}, []string{"/logs/a"}, permSubscribe, "/logs/b", false},
+		// a pattern subscription needs a grant covering everything it matches
+		{[]string{permSubscribe}, []string{"/logs/a"}, permSubscribe, "/logs/**", false},
+		{[]string{permSubscribe}, []string{"/logs/a"}, permSubscribe, "/logs/*", false},
+		{[]string{permSubscribe}, []string{"/logs/**"}, permSubscribe, "/logs/**", true},
+		{[]string{permSubscribe}, []string{"/logs/**"}, permSubscribe, "/logs/a/*", true},
+		{[]string{permSubscribe}, []string{"/logs/*"}, permSubscribe, "/logs/a/b", false},
+		{[]string{permSubscribe}, []string{"/logs/*"}, permSubscribe, "/**", false},
+		{[]string{permSubscribe}, []string{"/audit/**", "/logs/*"}, permSubscribe, "/logs/a", true},
+	}
+	for _, tc := range cases {
+		p := &principal{Perms: tc.perms, Channels: tc.channels}
+		if got := p.can(tc.perm, tc.channel); got != tc.want {
+			t.Errorf("%v@%v can(%s, %s) = %v, want %v", tc.perms, tc.channels, tc.perm, tc.channel, got, tc.want)
+		}
+	}
+	if !(&principal{open: true}).can(permAdmin, "/**") {
+		t.Error("open principal refused")
+	}
+}
+
+func TestSignedTokens(t *testing.T) {
+	a := &authConfig{static: map[string]*principal{}, secret: []byte("secret")}
+	valid := a.sign(&principal{Sub: "ci", Perms: []string{permPublish}, Channels: []string{"/builds/**"}, Exp: time.Now().Add(time.Hour).Unix()})
+	p, err := a.verify(valid)
+	if err != nil || p.Sub != "ci" || !p.can(permPublish, "/builds/1") || p.can(permPublish, "/logs/1") {
+		t.Fatalf("verify(valid) = %+v, %v", p, err)
+	}
+	body, sig, _ := strings.Cut(valid, ".")
+	forged := a.sign(&principal{Perms: []string{permAdmin}})
+	forgedBody, _, _ := strings.Cut(forged, ".")
+	cases := map[string]string{
+		"expired":            a.sign(&principal{Perms: []string{permPublish}, Exp: time.Now().Add(-time.Second).Unix()}),
+		"claims swapped":     forgedBody + "." + sig,
+		"signature tampered": body + "." + strings.Repeat("A", len(sig)),
+		"no signature":       body,
+		"other secret":       (&authConfig{secret: []byte("other")}).sign(&principal{Perms: []string{permAdmin}}),
+		"claims not json":    "bm90LWpzb24." + sig,
+		"empty":              "",
+	}
+	for name, tok := range cases {
+		if _, err := a.verify(tok); err != errUnauthorized {
+			t.Errorf("%s token: verify = %v, want errUnauthorized", name, err)
+		}
+	}
+	if _, err := (&authConfig{}).verify(valid); err != errUnauthorized {
+		t.Error("signed token accepted without AUTH_SECRET")
+	}
+	if p, _ := a.verify(a.sign(&principal{Perms: []string{permPublish}})); p == nil || !strings.HasPrefix(p.Sub, "signed:") {
+		t.Errorf("token without sub gets identity %+v, want a signed: hash", p)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	s := &Server{}
+	s.auth.Store(&authConfig{static: map[string]*principal{
+		"pub": {Sub: "pub", Perms: []string{permPublish}, Channels: []string{"/logs/**"}},
+		"sub": {Sub: "sub", Perms: []string{permSubscribe}},
+	}})
+	cases := []struct {
+		name, method, target string
+		header               map[string]string
+		perm                 string
+		status               int
+	}{
+		{"bearer", http.MethodPost, "/logs/a", map[string]string{"Authorization": "Bearer pub"}, permPublish, http.StatusOK},
+		{"no token", http.MethodPost, "/logs/a", nil, permPublish, http.StatusUnauthorized},
+		{"unknown token", http.MethodPost, "/logs/a", map[string]string{"Authorization": "Bearer nope"}, permPublish, http.StatusUnauthorized},
+		{"outside grant", http.MethodPost, "/audit/a", map[string]string{"Authorization": "Bearer pub"}, permPublish, http.StatusForbidden},
+		{"missing perm", http.MethodPost, "/logs/a", map[string]string{"Authorization": "Bearer sub"}, permPublish, http.StatusForbidden},
+		{"query token on upgrade", http.MethodGet, "/logs/a?token=sub", map[string]string{"Upgrade": "websocket"}, permSubscribe, http.StatusOK},
+		{"query token on POST", http.MethodPost, "/logs/a?token=pub", nil, permPublish, http.StatusUnauthorized},
+		{"query token on plain GET", http.MethodGet, "/logs/a?token=sub", nil, permSubscribe, http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		for k, v := range tc.header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		p := s.authorize(w, r, tc.perm, r.URL.Path)
+		if (p != nil) != (tc.status == http.StatusOK) || (p == nil && w.Code != tc.status) {
+			t.Errorf("%s: principal %v, status %d; want status %d", tc.name, p, w.Code, tc.status)
+		}
+	}
+}
+
+func TestRedactToken(t *testing.T) {
+	var seen *http.Request
+	h := redactToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = r }))
+	r := httptest.NewRequest(http.MethodGet, "/logs/a?last=5&token=s3cret", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if strings.Contains(seen.RequestURI, "s3cret") || !strings.Contains(seen.RequestURI, "token=redacted") || !strings.Contains(seen.RequestURI, "last=5") {
+		t.Fatalf("RequestURI = %q, want the token redacted and the rest kept", seen.RequestURI)
+	}
+	// the handler still authenticates with the real token
+	if seen.URL.Query().Get("token") != "s3cret" {
+		t.Fatalf("token lost from the URL: %q", seen.URL.RawQuery)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/logs/a?last=5", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if seen.RequestURI != "/logs/a?last=5" {
+		t.Fatalf("RequestURI without a token changed to %q", seen.RequestURI)
+	}
+}
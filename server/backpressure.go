@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backpressure modes, chosen per channel with BACKPRESSURE.
+const (
+	dropNewest = "drop-newest" // default: a full queue refuses the new message
+	dropOldest = "drop-oldest" // a full queue evicts its oldest message
+	disconnect = "disconnect"  // drop-newest, and close a client after limit drops
+	block      = "block"       // wait up to timeout for room, then drop
+)
+
+// gapFlushInterval is how often a hub reports drops that no later message carried.
+const gapFlushInterval = time.Second
+
+type backpressure struct {
+	mode    string
+	limit   int64         // disconnect: drops before a client is closed
+	timeout time.Duration // block: longest wait for queue room
+}
+
+type channelPolicy struct {
+	pattern string
+	backpressure
+}
+
+// parseBackpressure reads "pattern=mode[:arg],..." where arg is the drop count
+// for disconnect and the wait for block, e.g.
+// "/audit/**=block:2s,/metrics/**=drop-oldest,/**=disconnect:500".
+// The first matching pattern applies.
+func parseBackpressure(v string) ([]channelPolicy, error) {
+	var out []channelPolicy
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		pat, spec, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid BACKPRESSURE entry %q: want pattern=mode[:arg]", part)
+		}
+		mode, arg, _ := strings.Cut(spec, ":")
+		p := channelPolicy{pattern: "/" + strings.Trim(pat, "/"), backpressure: backpressure{mode: mode}}
+		switch mode {
+		case dropNewest, dropOldest:
+		case disconnect:
+			n, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid BACKPRESSURE entry %q: disconnect needs a drop count", part)
+			}
+			p.limit = n
+		case block:
+			d, err := time.ParseDuration(arg)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid BACKPRESSURE entry %q: block needs a timeout", part)
+			}
+			p.timeout = d
+		default:
+			return nil, fmt.Errorf("invalid BACKPRESSURE mode %q", mode)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func policiesFromEnv() ([]channelPolicy, error) {
+	return parseBackpressure(os.Getenv("BACKPRESSURE"))
+}
+
+// policyFor returns the backpressure of the first policy covering channel.
+func (s *Server) policyFor(channel string) backpressure {
+	for _, p := range s.policies {
+		if coversChannel(p.pattern, channel) {
+			return p.backpressure
+		}
+	}
+	return backpressure{mode: dropNewest}
+}
+
+// gapNotice is the system message sent to a client in place of skipped messages.
+func gapNotice(skipped int64) map[string]any {
+	return map[string]any{
+		"title":   "System",
+		"level":   "warn",
+		"message": fmt.Sprintf("%d messages skipped", skipped),
+		"system":  true,
+		"gap":     map[string]int64{"skipped": skipped},
+	}
+}
+
+func plainGapNotice(skipped int64) []byte {
+	b, _ := json.Marshal(gapNotice(skipped))
+	return b
+}
+
+// offer queues m on the hub without waiting, evicting the oldest queued
+// message for drop-oldest; evictions are added to m.skipped.
+func (h *Hub) offer(m *hubMsg) bool {
+	select {
+	case h.in <- *m:
+		return true
+	default:
+	}
+	switch h.policy.mode {
+	case dropOldest:
+		select {
+		case old := <-h.in:
+			m.skipped += old.skipped + 1
+			h.stats.hubDrops.Add(1)
+		default:
+		}
+		select {
+		case h.in <- *m:
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// wait blocks up to the policy timeout for room in the hub queue. The caller
+// is counted in h.waiting and holds no lock, so Add and Remove on a busy
+// channel do not stall run behind it.
+func (h *Hub) wait(m *hubMsg) bool {
+	t := time.NewTimer(h.policy.timeout)
+	defer t.Stop()
+	select {
+	case h.in <- *m:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// deliver queues m on c's send channel the same way. Caller is run, holding
+// no lock; a block wait ends early if c is removed meanwhile.
+func (h *Hub) deliver(c *client, m outMsg) bool {
+	select {
+	case c.send <- m:
+		return true
+	default:
+	}
+	switch h.policy.mode {
+	case dropOldest:
+		select {
+		case old := <-c.send:
+			m.skipped += old.skipped + 1
+			h.stats.clientDrops.Add(1)
+		default:
+		}
+		select {
+		case c.send <- m:
+			return true
+		default:
+		}
+	case block:
+		t := time.NewTimer(h.policy.timeout)
+		defer t.Stop()
+		select {
+		case c.send <- m:
+			return true
+		case <-c.done:
+		case <-t.C:
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestParseBackpressure(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    []channelPolicy
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "/logs/**=drop-oldest", want: []channelPolicy{{"/logs/**", backpressure{mode: dropOldest}}}},
+		{in: "audit/**/=block:2s, /**=disconnect:500", want: []channelPolicy{
+			{"/audit/**", backpressure{mode: block, timeout: 2 * time.Second}},
+			{"/**", backpressure{mode: disconnect, limit: 500}},
+		}},
+		{in: "/x=drop-newest,,", want: []channelPolicy{{"/x", backpressure{mode: dropNewest}}}},
+		{in: "/x", wantErr: true},
+		{in: "/x=fast", wantErr: true},
+		{in: "/x=disconnect", wantErr: true},
+		{in: "/x=disconnect:0", wantErr: true},
+		{in: "/x=block", wantErr: true},
+		{in: "/x=block:-1s", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := parseBackpressure(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseBackpressure(%q) error = %v, wantErr %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("parseBackpressure(%q) = %+v, want %+v", tc.in, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("parseBackpressure(%q)[%d] = %+v, want %+v", tc.in, i, got[i], tc.want[i])
+			}
+		}
+	}
+}
+
+func TestBlockingPublishHoldsNoLock(t *testing.T) {
+	h := NewHub(0, 0)
+	h.policy = backpressure{mode: block, timeout: 5 * time.Second}
+	for len(h.in) < cap(h.in) {
+		h.in <- hubMsg{}
+	}
+	done := make(chan bool)
+	go func() { done <- h.Broadcast(context.Background(), []byte(`{}`)) }()
+	for h.waiting.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	locked := make(chan struct{})
+	go func() {
+		// what Add and Remove do on a busy channel
+		h.mu.Lock()
+		h.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("hub lock held by a blocked publisher")
+	}
+	if h.close() {
+		t.Fatal("hub reaped under a waiting publisher")
+	}
+	<-h.in
+	if !<-done {
+		t.Fatal("publish reported a reaped hub")
+	}
+	if n := h.stats.hubDrops.Load(); n != 0 {
+		t.Fatalf("publish dropped %d messages despite room", n)
+	}
+}
+
+func TestBlockedClientHoldsNoLock(t *testing.T) {
+	h := NewHub(0, 0)
+	h.policy = backpressure{mode: block, timeout: 5 * time.Second}
+	conn := &websocket.Conn{}
+	c := &client{conn: conn, send: make(chan outMsg, 1), done: make(chan struct{})}
+	c.send <- outMsg{}
+	h.clients[conn] = c
+	h.stats.subscribers.Add(1)
+	done := make(chan struct{})
+	go func() { h.fanout(hubMsg{data: []byte(`{}`)}); close(done) }()
+	time.Sleep(50 * time.Millisecond)
+	removed := make(chan struct{})
+	go func() { h.Remove(conn); close(removed) }()
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("hub lock held while waiting on a slow client")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("fanout kept waiting on a removed client")
+	}
+}
+
+func TestFilteredClientGetsGapNotice(t *testing.T) {
+	h := NewHub(0, 0)
+	filter, err := parseSubFilter(url.Values{"level": {"error"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &websocket.Conn{}
+	c := &client{conn: conn, send: make(chan outMsg, 4), done: make(chan struct{}), filter: filter}
+	h.clients[conn] = c
+	h.fanout(hubMsg{data: []byte(`{"level":"info"}`), skipped: 5})
+	if len(c.send) != 0 {
+		t.Fatal("filtered-out message delivered")
+	}
+	h.flushGaps()
+	select {
+	case m := <-c.send:
+		if m.skipped != 5 || m.data != nil {
+			t.Fatalf("gap notice = %+v, want 5 skipped", m)
+		}
+	default:
+		t.Fatal("no gap notice for hub-queue drops behind a filtered message")
+	}
+	h.fanout(hubMsg{data: []byte(`{"level":"error"}`), skipped: 2})
+	if m := <-c.send; m.skipped != 2 || m.data == nil {
+		t.Fatalf("matching message = %+v, want it with 2 skipped", m)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// maxBatchBytes bounds a decompressed NDJSON batch body; each line is still limited to maxBodyBytes.
+const maxBatchBytes = 32 << 20
+
+// batchLineError reports one rejected line of a batch, numbered from 1.
+type batchLineError struct {
+	Line   int    `json:"line"`
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+type batchResult struct {
+	OK         bool             `json:"ok"`
+	Accepted   int              `json:"accepted"`
+	Duplicates int              `json:"duplicates"`
+	Rejected   int              `json:"rejected"`
+	Errors     []batchLineError `json:"errors,omitempty"`
+}
+
+func isNDJSON(r *http.Request) bool {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mt == "application/x-ndjson" || mt == "application/ndjson"
+}
+
+// ingestBatch publishes every line of an NDJSON body in order. Blank lines are
+// skipped; a bad line is reported and does not stop the rest. The whole body
+// is read first, so one that is too large or fails to decompress is refused
+// before any of its lines is published.
+func (s *Server) ingestBatch(w http.ResponseWriter, r *http.Request, p *principal, channel string) {
+	rc, err := requestBody(w, r, maxBatchBytes)
+	if err != nil {
+		writeIngestError(w, err)
+		return
+	}
+	defer rc.Close()
+	body, err := io.ReadAll(rc)
+	if err != nil {
+		writeIngestError(w, bodyError(err, "batch too large"))
+		return
+	}
+	ip := clientIP(r)
+	var res batchResult
+	for n := 1; len(body) > 0; n++ {
+		line, rest, _ := bytes.Cut(body, []byte{'\n'})
+		body = rest
+		if line = bytes.TrimSpace(line); len(line) == 0 {
+			continue
+		}
+		lerr := s.admit(p, ip, channel, len(line))
+		if lerr == nil {
+			_, lerr = s.ingest(r.Context(), channel, line, false)
+		}
+		switch {
+		case lerr == nil:
+			res.Accepted++
+		case lerr == errDuplicate:
+			res.Duplicates++
+		default:
+			res.Rejected++
+			res.Errors = append(res.Errors, batchLineError{Line: n, Status: errorStatus(lerr), Error: lerr.Error()})
+		}
+	}
+	res.OK = res.Rejected == 0
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// errorStatus is the HTTP status writeIngestError would use for err.
+func errorStatus(err error) int {
+	switch e := err.(type) {
+	case *ingestError:
+		return e.status
+	case *limitError:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBatchRefusedBodyPublishesNothing(t *testing.T) {
+	gz := func(body []byte) []byte {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		_, _ = zw.Write(body)
+		_ = zw.Close()
+		return b.Bytes()
+	}
+	huge := append([]byte("{\"n\":1}\n"), bytes.Repeat([]byte(" "), maxBatchBytes)...)
+	valid := gz([]byte("{\"n\":1}\n{\"n\":2}\n"))
+	cases := []struct {
+		name   string
+		body   []byte
+		status int
+	}{
+		{"too large after decompression", gz(huge), http.StatusRequestEntityTooLarge},
+		{"truncated gzip", valid[:len(valid)-6], http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{
+				hubs:     make(map[string]*Hub),
+				patterns: make(map[string]*Hub),
+				dormant:  make(map[string]dormantRing),
+				keys:     newKeyring(1, []byte("test-key")),
+				dedup:    newDedupCache(100, time.Minute),
+				metrics:  newMetrics(10),
+			}
+			s.limits.Store(&limits{})
+			r := httptest.NewRequest(http.MethodPost, "/logs/app", bytes.NewReader(tc.body))
+			r.Header.Set("Content-Type", "application/x-ndjson")
+			r.Header.Set("Content-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			s.ingestBatch(w, r, &principal{open: true}, "/logs/app")
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if len(s.hubs) != 0 {
+				t.Fatal("lines of a refused batch were published")
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMaxWindow is the largest zstd window accepted regardless of the body
+// limit: the 8MB that zstd uses at its default levels.
+const zstdMaxWindow = 8 << 20
+
+// requestBody returns r.Body decoded per Content-Encoding (gzip or zstd) and
+// limited to limit bytes after decompression, so a small compressed body
+// cannot expand past the limit.
+func requestBody(w http.ResponseWriter, r *http.Request, limit int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		rc = r.Body
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, &ingestError{http.StatusBadRequest, "invalid gzip body"}
+		}
+		rc = zr
+	case "zstd":
+		// the size limit below bounds the output; the memory cap only has to
+		// admit the windows common encoders declare, even for small bodies
+		zr, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(max(uint64(limit)+1, zstdMaxWindow)))
+		if err != nil {
+			return nil, &ingestError{http.StatusBadRequest, "invalid zstd body"}
+		}
+		rc = zr.IOReadCloser()
+	default:
+		return nil, &ingestError{http.StatusUnsupportedMediaType, "unsupported Content-Encoding " + enc}
+	}
+	return http.MaxBytesReader(w, rc, limit), nil
+}
+
+// bodyError maps a failed read of a requestBody to an ingestError.
+func bodyError(err error, tooLarge string) error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) || errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return &ingestError{http.StatusRequestEntityTooLarge, tooLarge}
+	}
+	return &ingestError{http.StatusBadRequest, "read error"}
+}
+
+// readPublishBody reads a single-message POST body, decompressed. JSON is passed through;
+// anything else is taken as plain text unless the client declared JSON.
+func readPublishBody(w http.ResponseWriter, r *http.Request) (json.RawMessage, error) {
+	rc, err := requestBody(w, r, maxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	body, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, bodyError(err, "message too large")
+	}
+	body = bytes.TrimSpace(body)
+	if json.Valid(body) {
+		return body, nil
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" || len(body) == 0 {
+		return nil, &ingestError{http.StatusBadRequest, "invalid json"}
+	}
+	return json.Marshal(map[string]string{"message": string(body)})
+}
+
+// wrapMessage turns a JSON scalar, array or null into {"message": value} so
+// every published message is an object.
+func wrapMessage(raw json.RawMessage) json.RawMessage {
+	if t := bytes.TrimSpace(raw); len(t) > 0 && t[0] == '{' {
+		return raw
+	}
+	out, err := json.Marshal(map[string]json.RawMessage{"message": raw})
+	if err != nil {
+		return raw
+	}
+	return out
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestRequestBodyLimits(t *testing.T) {
+	const limit = 1 << 10
+	gz := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(b)
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+	zs := func(b []byte) []byte {
+		zw, _ := zstd.NewWriter(nil)
+		defer zw.Close()
+		return zw.EncodeAll(b, nil)
+	}
+	zstream := func(b []byte) []byte {
+		// a streaming encoder declares its full window, not the body size
+		var buf bytes.Buffer
+		zw, _ := zstd.NewWriter(&buf)
+		_, _ = zw.Write(b)
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+	fits := bytes.Repeat([]byte("a"), limit)
+	over := bytes.Repeat([]byte("a"), limit+1)
+	bomb := bytes.Repeat([]byte("a"), 64<<20)
+	cases := []struct {
+		name, encoding string
+		body           []byte
+		status         int // 0: read succeeds
+	}{
+		{"plain at limit", "", fits, 0},
+		{"plain over limit", "", over, http.StatusRequestEntityTooLarge},
+		{"gzip at limit", "gzip", gz(fits), 0},
+		{"gzip over limit after decompression", "gzip", gz(over), http.StatusRequestEntityTooLarge},
+		{"gzip bomb", "x-gzip", gz(bomb), http.StatusRequestEntityTooLarge},
+		{"zstd at limit", "zstd", zs(fits), 0},
+		{"zstd stream at limit", "zstd", zstream(fits), 0},
+		{"zstd over limit after decompression", "zstd", zs(over), http.StatusRequestEntityTooLarge},
+		{"zstd bomb", "zstd", zs(bomb), http.StatusRequestEntityTooLarge},
+		{"corrupt gzip", "gzip", []byte("not gzip"), http.StatusBadRequest},
+		{"truncated gzip", "gzip", gz(fits)[:20], http.StatusBadRequest},
+		{"unsupported encoding", "br", fits, http.StatusUnsupportedMediaType},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(tc.body) > 1<<20 {
+				t.Fatalf("compressed test body is %d bytes", len(tc.body))
+			}
+			r := httptest.NewRequest(http.MethodPost, "/c", bytes.NewReader(tc.body))
+			if tc.encoding != "" {
+				r.Header.Set("Content-Encoding", tc.encoding)
+			}
+			w := httptest.NewRecorder()
+			rc, err := requestBody(w, r, limit)
+			var got []byte
+			if err == nil {
+				got, err = io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					err = bodyError(err, "too large")
+				}
+			}
+			if tc.status == 0 {
+				if err != nil || !bytes.Equal(got, fits) {
+					t.Fatalf("read %d bytes, %v; want %d", len(got), err, len(fits))
+				}
+				return
+			}
+			if status := errorStatus(err); err == nil || status != tc.status {
+				t.Fatalf("error %v (status %d), want status %d", err, status, tc.status)
+			}
+		})
+	}
+}
+
+func TestReadPublishBody(t *testing.T) {
+	gz := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write([]byte(s))
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+	cases := []struct {
+		name, contentType, encoding string
+		body                        []byte
+		want                        string
+		status                      int
+	}{
+		{"json object", "application/json", "", []byte(` {"level":"info"} `), `{"level":"info"}`, 0},
+		{"json without content type", "", "", []byte(`[1,2]`), `[1,2]`, 0},
+		{"plain text", "text/plain", "", []byte("disk full\n"), `{"message":"disk full"}`, 0},
+		{"plain text with charset", "text/plain; charset=utf-8", "", []byte(`say "hi"`), `{"message":"say \"hi\""}`, 0},
+		{"text/plain that is valid json", "text/plain", "", []byte(`{"level":"error"}`), `{"level":"error"}`, 0},
+		{"text/plain json scalar", "text/plain", "", []byte(`42`), `42`, 0},
+		{"gzipped text", "text/plain", "gzip", gz("compressed"), `{"message":"compressed"}`, 0},
+		{"invalid json declared json", "application/json", "", []byte(`{"level":`), "", http.StatusBadRequest},
+		{"invalid json with params", "application/json; charset=utf-8", "", []byte(`not json`), "", http.StatusBadRequest},
+		{"empty body", "text/plain", "", nil, "", http.StatusBadRequest},
+		{"whitespace body", "", "", []byte(" \n\t"), "", http.StatusBadRequest},
+		{"too large", "text/plain", "", bytes.Repeat([]byte("a"), maxBodyBytes+1), "", http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/c", bytes.NewReader(tc.body))
+			if tc.contentType != "" {
+				r.Header.Set("Content-Type", tc.contentType)
+			}
+			if tc.encoding != "" {
+				r.Header.Set("Content-Encoding", tc.encoding)
+			}
+			got, err := readPublishBody(httptest.NewRecorder(), r)
+			if tc.status == 0 {
+				if err != nil || string(got) != tc.want {
+					t.Fatalf("readPublishBody = %s, %v; want %s", got, err, tc.want)
+				}
+				return
+			}
+			if status := errorStatus(err); err == nil || status != tc.status {
+				t.Fatalf("readPublishBody = %s, %v (status %d); want status %d", got, err, status, tc.status)
+			}
+		})
+	}
+}
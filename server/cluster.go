@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+const (
+	peerQueueSize     = 4096
+	peerPingInterval  = 15 * time.Second
+	peerBackoffMin    = 500 * time.Millisecond
+	peerBackoffMax    = 30 * time.Second
+	nodeTokenMaxSkew  = 5 * time.Minute
+	clusterStreamPath = "/_cluster/stream"
+	// nodeHeader carries the accepting node's id in the stream handshake response
+	nodeHeader = "X-LogHUD-Node"
+)
+
+// clusterFrame is one frame on /_cluster/stream. Type is Msg, Ack, Ping or Members.
+type clusterFrame struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Channel string          `json:"channel,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	NodeID  string          `json:"nodeId,omitempty"`
+	Members []member        `json:"members,omitempty"`
+	// Sealed replaces Data on Msg frames when PEER_ENCRYPTION is on
+	Sealed     []byte `json:"sealed,omitempty"`
+	KeyVersion int    `json:"keyVersion,omitempty"`
+}
+
+// peerLink is the persistent outbound stream to one peer. Only Msg frames are
+// tracked for acks; Members and Ping frames are fire-and-forget.
+type peerLink struct {
+	s      *Server
+	base   string
+	queue  chan clusterFrame
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	inflight  map[string]clusterFrame // sent, waiting for Ack
+	resend    []clusterFrame
+	connected bool
+	lastErr   string
+
+	sent, acked, dropped, failed, reconnects atomic.Int64
+}
+
+// peerStats is the JSON view of a peerLink served by /_cluster/stats.
+type peerStats struct {
+	Address    string `json:"address"`
+	Connected  bool   `json:"connected"`
+	Queued     int    `json:"queued"`
+	Inflight   int    `json:"inflight"`
+	Sent       int64  `json:"sent"`
+	Acked      int64  `json:"acked"`
+	Dropped    int64  `json:"dropped"`
+	Failed     int64  `json:"failed"`
+	Reconnects int64  `json:"reconnects"`
+	LastError  string `json:"lastError,omitempty"`
+}
+
+func newPeerLink(s *Server, base string) *peerLink {
+	return &peerLink{
+		s:        s,
+		base:     strings.TrimRight(base, "/"),
+		queue:    make(chan clusterFrame, peerQueueSize),
+		inflight: make(map[string]clusterFrame),
+	}
+}
+
+// enqueue never blocks the publisher; a full queue drops the frame.
+func (p *peerLink) enqueue(f clusterFrame) {
+	select {
+	case p.queue <- f:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+// run keeps the stream to the peer open until ctx is done, reconnecting with backoff.
+func (p *peerLink) run(ctx context.Context) {
+	backoff := peerBackoffMin
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := p.session(ctx)
+		p.setConnected(false, err)
+		if ctx.Err() != nil {
+			return
+		}
+		p.reconnects.Add(1)
+		if time.Since(start) > peerBackoffMax {
+			backoff = peerBackoffMin
+		}
+		// full jitter keeps a restarted cluster from reconnecting in lockstep
+		wait := time.Duration(rand.Int63n(int64(backoff))) + peerBackoffMin
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, peerBackoffMax)
+	}
+}
+
+func (p *peerLink) setConnected(v bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connected = v
+	if err != nil {
+		p.lastErr = err.Error()
+	}
+	if !v {
+		// unacked frames go out again first on the next session
+		for _, f := range p.inflight {
+			p.resend = append(p.resend, f)
+		}
+		sort.Slice(p.resend, func(i, j int) bool { return p.resend[i].ID < p.resend[j].ID })
+		clear(p.inflight)
+	}
+}
+
+func (p *peerLink) session(ctx context.Context) error {
+	dctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	c, resp, err := websocket.Dial(dctx, p.base+clusterStreamPath, &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": []string{"Bearer " + p.s.nodeToken(time.Now())}},
+		HTTPClient: &http.Client{Transport: p.s.httpc.Transport},
+	})
+	cancel()
+	if err != nil {
+		return err
+	}
+	if id := resp.Header.Get(nodeHeader); id == p.s.nodeID {
+		// an address of our own learned through PEERS or gossip
+		c.Close(websocket.StatusNormalClosure, "self")
+		p.s.forgetSelf(p.base)
+		return errSelfLink
+	} else if id != "" {
+		p.s.learnMembers([]member{{NodeID: id, Address: p.base}})
+	}
+	c.SetReadLimit(maxBodyBytes + 4096)
+	defer c.Close(websocket.StatusGoingAway, "reconnect")
+	p.setConnected(true, nil)
+	p.s.touchMember(p.base, "")
+
+	sctx, stop := context.WithCancel(ctx)
+	defer stop()
+	var lastSeen atomic.Int64
+	lastSeen.Store(time.Now().UnixNano())
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			var f clusterFrame
+			if err := readClusterFrame(sctx, c, &f); err != nil {
+				readErr <- err
+				return
+			}
+			lastSeen.Store(time.Now().UnixNano())
+			p.s.touchMember(p.base, "")
+			if f.Type == "Ack" {
+				p.ack(f)
+			}
+		}
+	}()
+
+	if err := writeClusterFrame(sctx, c, p.s.membersFrame()); err != nil {
+		return err
+	}
+	// key material only goes to peers proven by the cluster CA
+	trusted := p.s.tls.verifiesPeer(resp.TLS)
+	if trusted {
+		// a peer that missed a rotation while disconnected catches up here
+		if err := writeClusterFrame(sctx, c, p.s.keysFrame()); err != nil {
+			return err
+		}
+	}
+	// ping often enough that a healthy peer never turns suspect
+	interval := max(min(peerPingInterval, p.s.suspectAfter/3), time.Second)
+	ping := time.NewTicker(interval)
+	defer ping.Stop()
+	for {
+		if f, ok := p.nextResend(); ok {
+			if err := p.send(sctx, c, f); err != nil {
+				return err
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-readErr:
+			return err
+		case f := <-p.queue:
+			if f.Type == "Keys" && !trusted {
+				continue
+			}
+			if err := p.send(sctx, c, f); err != nil {
+				return err
+			}
+		case now := <-ping.C:
+			if now.Sub(time.Unix(0, lastSeen.Load())) > 3*interval {
+				return errPeerIdle
+			}
+			if err := writeClusterFrame(sctx, c, clusterFrame{Type: "Ping", ID: strconv.FormatInt(now.UnixNano(), 10)}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+var (
+	errPeerIdle = errors.New("peer idle")
+	errSelfLink = errors.New("address is this node")
+)
+
+func (p *peerLink) nextResend() (clusterFrame, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.resend) == 0 {
+		return clusterFrame{}, false
+	}
+	f := p.resend[0]
+	p.resend = p.resend[1:]
+	return f, true
+}
+
+func (p *peerLink) send(ctx context.Context, c *websocket.Conn, f clusterFrame) error {
+	if f.Type != "Msg" {
+		return writeClusterFrame(ctx, c, f)
+	}
+	p.mu.Lock()
+	if len(p.inflight) >= peerQueueSize {
+		// the peer stopped acking; keep memory bounded
+		p.mu.Unlock()
+		p.dropped.Add(1)
+		return nil
+	}
+	p.inflight[f.ID] = f
+	p.mu.Unlock()
+	if err := writeClusterFrame(ctx, c, f); err != nil {
+		return err
+	}
+	p.sent.Add(1)
+	return nil
+}
+
+func (p *peerLink) ack(f clusterFrame) {
+	p.mu.Lock()
+	_, ok := p.inflight[f.ID]
+	delete(p.inflight, f.ID)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	if f.Error != "" {
+		p.failed.Add(1)
+		return
+	}
+	p.acked.Add(1)
+}
+
+func (p *peerLink) stats() peerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return peerStats{
+		Address:    p.base,
+		Connected:  p.connected,
+		Queued:     len(p.queue) + len(p.resend),
+		Inflight:   len(p.inflight),
+		Sent:       p.sent.Load(),
+		Acked:      p.acked.Load(),
+		Dropped:    p.dropped.Load(),
+		Failed:     p.failed.Load(),
+		Reconnects: p.reconnects.Load(),
+		LastError:  p.lastErr,
+	}
+}
+
+func readClusterFrame(ctx context.Context, c *websocket.Conn, f *clusterFrame) error {
+	_, data, err := c.Read(ctx)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, f)
+}
+
+func writeClusterFrame(ctx context.Context, c *websocket.Conn, f clusterFrame) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return c.Write(wctx, websocket.MessageText, b)
+}
+
+// forwardToPeers queues the envelope on the stream of every peer not considered dead.
+func (s *Server) forwardToPeers(channel string, envelope []byte) {
+	links := s.liveLinks()
+	if len(links) == 0 {
+		return
+	}
+	m, _ := parseMeta(envelope)
+	f := clusterFrame{Type: "Msg", ID: m.ID, Channel: channel, Data: envelope}
+	if s.encryptPeers {
+		if err := s.sealFrame(&f); err != nil {
+			log.Println("cluster seal:", err)
+			return
+		}
+	}
+	for _, l := range links {
+		l.enqueue(f)
+	}
+}
+
+// nodeToken authenticates this node on a peer's stream:
+// base64url(nodeId) "." unixSeconds "." base64url(HMAC-SHA256(key, nodeId "." unixSeconds)).
+func (s *Server) nodeToken(now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	_, key := s.keys.signing()
+	return base64.RawURLEncoding.EncodeToString([]byte(s.nodeID)) + "." + ts + "." + signToken(key, s.nodeID+"."+ts)
+}
+
+func signToken(key []byte, v string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(v))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (s *Server) verifyNodeToken(tok string) (string, bool) {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	node, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > nodeTokenMaxSkew || d < -nodeTokenMaxSkew {
+		return "", false
+	}
+	// a peer may still sign with a key this node has just replaced, or not yet activated
+	for _, key := range s.keys.valid() {
+		want := signToken(key, string(node)+"."+parts[1])
+		if hmac.Equal([]byte(want), []byte(parts[2])) {
+			return string(node), true
+		}
+	}
+	return "", false
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// clusterStream accepts a peer's persistent stream and publishes its Msg frames locally.
+func (s *Server) clusterStream(w http.ResponseWriter, r *http.Request) {
+	if s.refuseDemoKey(w) {
+		return
+	}
+	peer, ok := s.verifyNodeToken(bearerToken(r))
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.memberLeft(peer) {
+		http.Error(w, "node was removed from the cluster", http.StatusForbidden)
+		return
+	}
+	w.Header().Set(nodeHeader, s.nodeID)
+	c, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		log.Println("cluster accept:", err)
+		return
+	}
+	c.SetReadLimit(maxBodyBytes + 4096)
+	defer c.Close(websocket.StatusNormalClosure, "bye")
+	log.Printf("cluster: stream from %s", peer)
+	for {
+		var f clusterFrame
+		if err := readClusterFrame(r.Context(), c, &f); err != nil {
+			return
+		}
+		s.touchMember("", peer)
+		var reply clusterFrame
+		switch f.Type {
+		case "Msg":
+			reply = clusterFrame{Type: "Ack", ID: f.ID}
+			if err := s.openMsg(&f); err != nil {
+				reply.Error = err.Error()
+				break
+			}
+			if _, err := s.ingest(r.Context(), f.Channel, f.Data, true); err != nil && err != errDuplicate {
+				reply.Error = err.Error()
+			}
+		case "Ping":
+			reply = clusterFrame{Type: "Ack", ID: f.ID}
+		case "Members":
+			s.learnMembers(f.Members)
+			continue
+		case "Keys":
+			if s.keys.usesDemoKey() || !s.tls.verifiesClient(r.TLS) {
+				continue
+			}
+			var kf keysFrame
+			if err := json.Unmarshal(f.Data, &kf); err == nil {
+				s.keys.merge(kf)
+			}
+			continue
+		default:
+			continue
+		}
+		if err := writeClusterFrame(r.Context(), c, reply); err != nil {
+			return
+		}
+	}
+}
+
+// openMsg decrypts a sealed Msg frame; with PEER_ENCRYPTION on, plaintext
+// frames are refused.
+func (s *Server) openMsg(f *clusterFrame) error {
+	if f.Sealed != nil {
+		return s.openFrame(f)
+	}
+	if s.encryptPeers {
+		return errors.New("plaintext payload refused")
+	}
+	return nil
+}
+
+// clusterStats serves per-peer delivery counters and duplicate suppression counts.
+func (s *Server) clusterStats(w http.ResponseWriter, r *http.Request) {
+	if !s.adminView(w, r) {
+		return
+	}
+	out := struct {
+		NodeID string      `json:"nodeId"`
+		Peers  []peerStats `json:"peers"`
+		Dedup  dedupStats  `json:"dedup"`
+	}{NodeID: s.nodeID, Peers: []peerStats{}, Dedup: s.dedup.stats()}
+	for _, l := range s.peerLinks() {
+		out.Peers = append(out.Peers, l.stats())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestVerifyNodeToken(t *testing.T) {
+	s := &Server{keys: newKeyring(1, []byte("k1")), nodeID: "n1"}
+	now := time.Now()
+	tok := s.nodeToken(now)
+	if node, ok := s.verifyNodeToken(tok); !ok || node != "n1" {
+		t.Fatalf("verifyNodeToken(own token) = %q, %v", node, ok)
+	}
+	parts := strings.Split(tok, ".")
+	other := &Server{keys: newKeyring(1, []byte("k2")), nodeID: "n1"}
+	cases := map[string]string{
+		"other node id":       base64.RawURLEncoding.EncodeToString([]byte("n2")) + "." + parts[1] + "." + parts[2],
+		"other timestamp":     parts[0] + "." + strconv.FormatInt(now.Unix()+1, 10) + "." + parts[2],
+		"other key":           other.nodeToken(now),
+		"too old":             s.nodeToken(now.Add(-nodeTokenMaxSkew - time.Minute)),
+		"too far ahead":       s.nodeToken(now.Add(nodeTokenMaxSkew + time.Minute)),
+		"missing signature":   parts[0] + "." + parts[1],
+		"node id not base64":  "n1!." + parts[1] + "." + parts[2],
+		"timestamp not a num": parts[0] + ".now." + parts[2],
+		"empty":               "",
+	}
+	for name, tok := range cases {
+		if node, ok := s.verifyNodeToken(tok); ok {
+			t.Errorf("%s: verified as %q", name, node)
+		}
+	}
+	for _, d := range []time.Duration{-nodeTokenMaxSkew + time.Minute, nodeTokenMaxSkew - time.Minute} {
+		if _, ok := s.verifyNodeToken(s.nodeToken(now.Add(d))); !ok {
+			t.Errorf("token %v off refused", d)
+		}
+	}
+}
+
+func TestVerifyNodeTokenKeyRotation(t *testing.T) {
+	s := &Server{keys: newKeyring(1, []byte("k1")), nodeID: "n1"}
+	peer := &Server{keys: newKeyring(1, []byte("k1")), nodeID: "n2"}
+	oldTok := peer.nodeToken(time.Now())
+
+	// a peer already on the next version is accepted before it is activated here
+	v2, _ := s.keys.rotate()
+	peer.keys.add(v2, s.keys.lookupAny(v2), time.Time{})
+	peer.keys.activate(v2, time.Hour)
+	if _, ok := s.verifyNodeToken(peer.nodeToken(time.Now())); !ok {
+		t.Fatal("token under an unactivated version refused")
+	}
+
+	s.keys.activate(v2, time.Hour)
+	if _, ok := s.verifyNodeToken(oldTok); !ok {
+		t.Fatal("token under the retired key refused within grace")
+	}
+	s.keys.setExpiry(1, time.Now().Add(-time.Second))
+	if _, ok := s.verifyNodeToken(oldTok); ok {
+		t.Fatal("token under an expired key verified")
+	}
+}
+
+func TestClusterStream(t *testing.T) {
+	s := &Server{
+		hubs:     make(map[string]*Hub),
+		patterns: make(map[string]*Hub),
+		dormant:  make(map[string]dormantRing),
+		keys:     newKeyring(1, []byte("k1")),
+		nodeID:   "n1",
+		dedup:    newDedupCache(100, time.Minute),
+		metrics:  newMetrics(10),
+		members:  make(map[string]*member),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(s.clusterStream))
+	t.Cleanup(ts.Close)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	dial := func(tok string) (*websocket.Conn, int) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, resp, err := websocket.Dial(ctx, url, &websocket.DialOptions{HTTPHeader: http.Header{"Authorization": {"Bearer " + tok}}})
+		if err != nil {
+			return nil, resp.StatusCode
+		}
+		t.Cleanup(func() { c.Close(websocket.StatusNormalClosure, "") })
+		return c, resp.StatusCode
+	}
+
+	forged := &Server{keys: newKeyring(1, []byte("guess")), nodeID: "n2"}
+	if _, code := dial(forged.nodeToken(time.Now())); code != http.StatusUnauthorized {
+		t.Fatalf("forged token: status %d, want 401", code)
+	}
+	peer := &Server{keys: newKeyring(1, []byte("k1")), nodeID: "n2"}
+	if _, code := dial(peer.nodeToken(time.Now().Add(-time.Hour))); code != http.StatusUnauthorized {
+		t.Fatalf("skewed token: status %d, want 401", code)
+	}
+
+	c, _ := dial(peer.nodeToken(time.Now()))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	call := func(f clusterFrame) clusterFrame {
+		if err := writeClusterFrame(ctx, c, f); err != nil {
+			t.Fatal(err)
+		}
+		var reply clusterFrame
+		if err := readClusterFrame(ctx, c, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	env, _ := peer.injectMeta("/logs/app", json.RawMessage(`{"message":"hi"}`))
+	m, _ := parseMeta(env)
+	if r := call(clusterFrame{Type: "Msg", ID: m.ID, Channel: "/logs/app", Data: env}); r.Type != "Ack" || r.ID != m.ID || r.Error != "" {
+		t.Fatalf("Msg = %+v", r)
+	}
+	s.mu.RLock()
+	h := s.hubs["/logs/app"]
+	s.mu.RUnlock()
+	if h == nil || h.stats.in.Load() != 1 {
+		t.Fatal("peer message not published")
+	}
+	if r := call(clusterFrame{Type: "Msg", ID: m.ID, Channel: "/logs/app", Data: env}); r.Error != "" {
+		t.Fatalf("duplicate Msg = %+v, want a plain ack", r)
+	}
+	if r := call(clusterFrame{Type: "Msg", ID: "x", Channel: "/logs/**", Data: env}); r.Type != "Ack" || r.Error == "" {
+		t.Fatalf("Msg to a pattern = %+v, want an error ack", r)
+	}
+	if r := call(clusterFrame{Type: "Ping", ID: "p"}); r.Type != "Ack" || r.ID != "p" {
+		t.Fatalf("Ping = %+v", r)
+	}
+
+	s.clusterMu.Lock()
+	s.members["a"] = &member{NodeID: "n2", Address: "a", State: stateLeft}
+	s.clusterMu.Unlock()
+	if _, code := dial(peer.nodeToken(time.Now())); code != http.StatusForbidden {
+		t.Fatalf("removed node: status %d, want 403", code)
+	}
+	s.keys.add(9, []byte(demoClusterKey), time.Time{})
+	if _, code := dial(peer.nodeToken(time.Now())); code != http.StatusForbidden {
+		t.Fatalf("demo key: status %d, want 403", code)
+	}
+}
+
+func TestPeerLinkAckAndRequeue(t *testing.T) {
+	p := newPeerLink(&Server{}, "http://peer")
+	for _, id := range []string{"c", "a", "b"} {
+		p.inflight[id] = clusterFrame{Type: "Msg", ID: id}
+	}
+	p.setConnected(true, nil)
+	p.ack(clusterFrame{Type: "Ack", ID: "b"})
+	p.ack(clusterFrame{Type: "Ack", ID: "c", Error: "invalid json"})
+	p.ack(clusterFrame{Type: "Ack", ID: "unknown"})
+	if st := p.stats(); st.Acked != 1 || st.Failed != 1 || st.Inflight != 1 || !st.Connected {
+		t.Fatalf("after acks: %+v", st)
+	}
+	p.inflight["d"] = clusterFrame{Type: "Msg", ID: "d"}
+
+	// a dropped connection queues the unacked frames for resending, in id order
+	p.setConnected(false, errors.New("reset"))
+	if st := p.stats(); st.Inflight != 0 || st.Queued != 2 || st.Connected || st.LastError != "reset" {
+		t.Fatalf("after disconnect: %+v", st)
+	}
+	// a late ack for a requeued frame changes nothing
+	p.ack(clusterFrame{Type: "Ack", ID: "a"})
+	var ids []string
+	for f, ok := p.nextResend(); ok; f, ok = p.nextResend() {
+		ids = append(ids, f.ID)
+	}
+	if strings.Join(ids, ",") != "a,d" {
+		t.Fatalf("resent %v, want [a d]", ids)
+	}
+	if st := p.stats(); st.Acked != 1 {
+		t.Fatalf("late ack counted: %+v", st)
+	}
+}
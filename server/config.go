@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultConfigFile is read from the working directory when CONFIG_FILE is unset.
+const defaultConfigFile = "config.json"
+
+// fileConfig is server/config.json. Every field maps onto the environment
+// variable that configures it; a variable set in the real environment wins
+// over the file.
+type fileConfig struct {
+	Listen          string `json:"listen"` // LISTEN_ADDR, e.g. ":8080"
+	NodeID          string `json:"nodeId"`
+	PublicURL       string `json:"publicUrl"`
+	AdminToken      string `json:"adminToken"`
+	ShutdownTimeout string `json:"shutdownTimeout"`
+	EnvelopeWindow  string `json:"envelopeWindow"`
+
+	TLS struct {
+		CertFile   string `json:"certFile"`
+		KeyFile    string `json:"keyFile"`
+		SelfSigned bool   `json:"selfSigned"` // development only
+		ClusterCA  string `json:"clusterCA"`  // require client certificates on /_cluster/*
+	} `json:"tls"`
+
+	Cluster struct {
+		Enabled        *bool             `json:"enabled"`
+		Peers          []string          `json:"peers"`
+		KeyVersion     int               `json:"keyVersion"`
+		ClusterKey     string            `json:"clusterKey"`
+		OlderKeys      map[string]string `json:"olderKeys"`      // retired version → key, below keyVersion
+		OlderKeysGrace string            `json:"olderKeysGrace"` // how long retired keys still verify
+		AcceptJoin     *bool             `json:"acceptJoin"`
+		JoinURL        string            `json:"joinUrl"`
+		JoinToken      string            `json:"joinToken"`
+		EncryptPeers   bool              `json:"encryptPeers"`
+		SuspectAfter   string            `json:"suspectAfter"`
+		DeadAfter      string            `json:"deadAfter"`
+		RemoveAfter    string            `json:"removeAfter"`
+	} `json:"cluster"`
+
+	Replay struct {
+		Max    *int   `json:"max"`
+		MaxAge string `json:"maxAge"`
+	} `json:"replay"`
+
+	Dedup struct {
+		Capacity *int   `json:"capacity"`
+		TTL      string `json:"ttl"`
+	} `json:"dedup"`
+
+	Store struct {
+		Dir          string `json:"dir"`
+		SegmentBytes string `json:"segmentBytes"`
+		SegmentAge   string `json:"segmentAge"`
+		MaxBytes     string `json:"maxBytes"`
+		MaxAge       string `json:"maxAge"`
+		Retention    []struct {
+			Pattern  string `json:"pattern"`
+			MaxBytes string `json:"maxBytes"`
+			MaxAge   string `json:"maxAge"`
+		} `json:"retention"`
+	} `json:"store"`
+
+	Auth struct {
+		// Disabled must be set to open every channel, and lets a reload
+		// drop a previously configured auth block
+		Disabled bool   `json:"disabled"`
+		Secret   string `json:"secret"`
+		Tokens   []struct {
+			Token    string   `json:"token"`
+			Perms    []string `json:"perms"`
+			Channels []string `json:"channels"`
+		} `json:"tokens"`
+	} `json:"auth"`
+
+	Limits struct {
+		Identity       string `json:"identity"` // "100/s[:burst]"
+		IP             string `json:"ip"`
+		Channel        string `json:"channel"`
+		DailyMessages  int64  `json:"dailyMessages"`
+		DailyBytes     string `json:"dailyBytes"`
+		MaxChannels    *int   `json:"maxChannels"`
+		HubIdleTimeout string `json:"hubIdleTimeout"`
+		Backpressure   []struct {
+			Pattern string `json:"pattern"`
+			Mode    string `json:"mode"`
+			Drops   int    `json:"drops"`   // disconnect
+			Timeout string `json:"timeout"` // block
+		} `json:"backpressure"`
+	} `json:"limits"`
+
+	Metrics struct {
+		MaxChannels *int `json:"maxChannels"`
+	} `json:"metrics"`
+}
+
+// reloadableEnv are the settings SIGHUP re-reads from the file.
+var reloadableEnv = []string{
+	"PEERS",
+	"AUTH_TOKENS", "AUTH_SECRET", "AUTH_DISABLED",
+	"RATE_LIMIT_IDENTITY", "RATE_LIMIT_IP", "RATE_LIMIT_CHANNEL",
+	"QUOTA_DAILY_MESSAGES", "QUOTA_DAILY_BYTES",
+}
+
+// configSource remembers where the file came from and which variables the
+// real environment set, so a reload does not override them.
+type configSource struct {
+	path    string
+	fromEnv map[string]bool
+}
+
+// loadConfig reads CONFIG_FILE (or ./config.json if present), validates it and
+// exports its settings as environment variables not already set. It returns
+// nil when there is no file.
+func loadConfig() (*configSource, error) {
+	path, explicit := os.LookupEnv("CONFIG_FILE")
+	if !explicit {
+		path = defaultConfigFile
+	}
+	env, err := readConfig(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	src := &configSource{path: path, fromEnv: make(map[string]bool)}
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		src.fromEnv[k] = true
+	}
+	for k, v := range env {
+		if !src.fromEnv[k] {
+			os.Setenv(k, v)
+		}
+	}
+	return src, nil
+}
+
+func readConfig(path string) (map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c fileConfig
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	env, err := c.env()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return env, nil
+}
+
+// env validates c and flattens it into environment variables.
+func (c *fileConfig) env() (map[string]string, error) {
+	env := make(map[string]string)
+	var errs []error
+	set := func(key, v string) {
+		if v != "" {
+			env[key] = v
+		}
+	}
+	dur := func(field, key, v string) {
+		if v == "" {
+			return
+		}
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			errs = append(errs, fmt.Errorf("%s: invalid duration %q", field, v))
+			return
+		}
+		env[key] = v
+	}
+	size := func(field, key, v string) {
+		if v == "" {
+			return
+		}
+		if _, err := parseSize(v); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+			return
+		}
+		env[key] = v
+	}
+	rate := func(field, key, v string) {
+		if v == "" {
+			return
+		}
+		if _, _, err := parseRate(v); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+			return
+		}
+		env[key] = v
+	}
+	count := func(field, key string, v *int) {
+		if v == nil {
+			return
+		}
+		if *v < 0 {
+			errs = append(errs, fmt.Errorf("%s: must not be negative", field))
+			return
+		}
+		env[key] = strconv.Itoa(*v)
+	}
+
+	set("LISTEN_ADDR", c.Listen)
+	set("NODE_ID", c.NodeID)
+	set("PUBLIC_URL", c.PublicURL)
+	set("ADMIN_TOKEN", c.AdminToken)
+	dur("shutdownTimeout", "SHUTDOWN_TIMEOUT", c.ShutdownTimeout)
+	dur("envelopeWindow", "ENVELOPE_WINDOW", c.EnvelopeWindow)
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls: certFile and keyFile go together"))
+	}
+	set("TLS_CERT_FILE", c.TLS.CertFile)
+	set("TLS_KEY_FILE", c.TLS.KeyFile)
+	if c.TLS.SelfSigned {
+		env["TLS_SELF_SIGNED"] = "true"
+	}
+	set("TLS_CLUSTER_CA", c.TLS.ClusterCA)
+
+	cl := c.Cluster
+	if cl.Enabled == nil || *cl.Enabled {
+		set("PEERS", strings.Join(cl.Peers, ","))
+		set("JOIN_URL", cl.JoinURL)
+		set("JOIN_TOKEN", cl.JoinToken)
+	}
+	set("CLUSTER_KEY", cl.ClusterKey)
+	if cl.KeyVersion < 0 {
+		errs = append(errs, errors.New("cluster.keyVersion: must be positive"))
+	} else if cl.KeyVersion > 0 {
+		env["CLUSTER_KEY_VERSION"] = strconv.Itoa(cl.KeyVersion)
+	}
+	var older []string
+	for ver, key := range cl.OlderKeys {
+		n, err := strconv.Atoi(ver)
+		if err != nil || n <= 0 || key == "" || strings.Contains(key, ",") {
+			errs = append(errs, fmt.Errorf("cluster.olderKeys: invalid entry %q", ver))
+			continue
+		}
+		if n >= max(cl.KeyVersion, 1) {
+			errs = append(errs, fmt.Errorf("cluster.olderKeys: version %d must be below keyVersion", n))
+			continue
+		}
+		older = append(older, ver+":"+key)
+	}
+	sort.Strings(older)
+	set("CLUSTER_KEYS", strings.Join(older, ","))
+	dur("cluster.olderKeysGrace", "CLUSTER_KEYS_GRACE", cl.OlderKeysGrace)
+	if cl.AcceptJoin != nil {
+		env["CLUSTER_ACCEPT_JOIN"] = strconv.FormatBool(*cl.AcceptJoin)
+	}
+	if cl.EncryptPeers {
+		env["PEER_ENCRYPTION"] = "true"
+	}
+	dur("cluster.suspectAfter", "MEMBER_SUSPECT_AFTER", cl.SuspectAfter)
+	dur("cluster.deadAfter", "MEMBER_DEAD_AFTER", cl.DeadAfter)
+	dur("cluster.removeAfter", "MEMBER_REMOVE_AFTER", cl.RemoveAfter)
+
+	count("replay.max", "REPLAY_MAX", c.Replay.Max)
+	dur("replay.maxAge", "REPLAY_MAX_AGE", c.Replay.MaxAge)
+	count("dedup.capacity", "DEDUP_CAPACITY", c.Dedup.Capacity)
+	dur("dedup.ttl", "DEDUP_TTL", c.Dedup.TTL)
+
+	st := c.Store
+	set("STORE_DIR", st.Dir)
+	size("store.segmentBytes", "STORE_SEGMENT_BYTES", st.SegmentBytes)
+	dur("store.segmentAge", "STORE_SEGMENT_AGE", st.SegmentAge)
+	size("store.maxBytes", "STORE_MAX_BYTES", st.MaxBytes)
+	dur("store.maxAge", "STORE_MAX_AGE", st.MaxAge)
+	var retention []string
+	for _, rp := range st.Retention {
+		retention = append(retention, rp.Pattern+":"+rp.MaxBytes+":"+rp.MaxAge)
+	}
+	if v := strings.Join(retention, ","); v != "" {
+		if _, err := parseRetention(v); err != nil {
+			errs = append(errs, fmt.Errorf("store.retention: %w", err))
+		}
+		env["STORE_RETENTION"] = v
+	}
+
+	if c.Auth.Disabled {
+		if c.Auth.Secret != "" || len(c.Auth.Tokens) > 0 {
+			errs = append(errs, errors.New("auth.disabled: conflicts with auth.secret and auth.tokens"))
+		}
+		env["AUTH_DISABLED"] = "true"
+	}
+	set("AUTH_SECRET", c.Auth.Secret)
+	var tokens []string
+	for i, t := range c.Auth.Tokens {
+		if t.Token == "" || strings.ContainsAny(t.Token, ";=") {
+			errs = append(errs, fmt.Errorf("auth.tokens[%d]: token must be non-empty without ';' or '='", i))
+			continue
+		}
+		if len(t.Perms) == 0 {
+			errs = append(errs, fmt.Errorf("auth.tokens[%d]: perms required", i))
+			continue
+		}
+		for _, p := range t.Perms {
+			if !validPerm(p) {
+				errs = append(errs, fmt.Errorf("auth.tokens[%d]: invalid permission %q", i, p))
+			}
+		}
+		entry := t.Token + "=" + strings.Join(t.Perms, "+")
+		if len(t.Channels) > 0 {
+			entry += "@" + strings.Join(t.Channels, ",")
+		}
+		tokens = append(tokens, entry)
+	}
+	set("AUTH_TOKENS", strings.Join(tokens, ";"))
+
+	lim := c.Limits
+	rate("limits.identity", "RATE_LIMIT_IDENTITY", lim.Identity)
+	rate("limits.ip", "RATE_LIMIT_IP", lim.IP)
+	rate("limits.channel", "RATE_LIMIT_CHANNEL", lim.Channel)
+	if lim.DailyMessages < 0 {
+		errs = append(errs, errors.New("limits.dailyMessages: must not be negative"))
+	} else if lim.DailyMessages > 0 {
+		env["QUOTA_DAILY_MESSAGES"] = strconv.FormatInt(lim.DailyMessages, 10)
+	}
+	size("limits.dailyBytes", "QUOTA_DAILY_BYTES", lim.DailyBytes)
+	count("limits.maxChannels", "MAX_CHANNELS", lim.MaxChannels)
+	dur("limits.hubIdleTimeout", "HUB_IDLE_TIMEOUT", lim.HubIdleTimeout)
+	var bp []string
+	for _, p := range lim.Backpressure {
+		spec := p.Pattern + "=" + p.Mode
+		switch p.Mode {
+		case disconnect:
+			spec += ":" + strconv.Itoa(p.Drops)
+		case block:
+			spec += ":" + p.Timeout
+		}
+		bp = append(bp, spec)
+	}
+	if v := strings.Join(bp, ","); v != "" {
+		if _, err := parseBackpressure(v); err != nil {
+			errs = append(errs, fmt.Errorf("limits.backpressure: %w", err))
+		}
+		env["BACKPRESSURE"] = v
+	}
+
+	count("metrics.maxChannels", "METRICS_MAX_CHANNELS", c.Metrics.MaxChannels)
+	return env, errors.Join(errs...)
+}
+
+// reloadConfig re-reads the config file on SIGHUP and applies the settings
+// that can change live: peers, client tokens and publish limits. Anything
+// invalid leaves the running configuration untouched.
+func (s *Server) reloadConfig() {
+	if s.config == nil {
+		log.Println("reload: no config file")
+		return
+	}
+	env, err := readConfig(s.config.path)
+	if err != nil {
+		log.Println("reload:", err)
+		return
+	}
+	prev := make(map[string]string)
+	for _, k := range reloadableEnv {
+		if s.config.fromEnv[k] {
+			continue
+		}
+		prev[k] = os.Getenv(k)
+		if v, ok := env[k]; ok {
+			os.Setenv(k, v)
+		} else {
+			os.Unsetenv(k)
+		}
+	}
+	restore := func() {
+		for k, v := range prev {
+			if v == "" {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, v)
+			}
+		}
+	}
+	auth, err := authFromEnv()
+	if err != nil {
+		log.Println("reload:", err)
+		restore()
+		return
+	}
+	// a file that merely lost its auth block must not open every channel
+	if auth == nil && s.auth.Load() != nil {
+		if !boolEnv("AUTH_DISABLED") {
+			log.Println("reload: refusing to turn auth off; set auth.disabled to open every channel")
+			restore()
+			return
+		}
+		log.Println("reload: auth disabled, every channel is open")
+	}
+	lim, err := limitsFromEnv()
+	if err != nil {
+		log.Println("reload:", err)
+		restore()
+		return
+	}
+	lim.quota.adopt(s.limits.Load().quota)
+	s.auth.Store(auth)
+	s.limits.Store(lim)
+	s.setPeers(peersFromEnv())
+	log.Printf("reload: applied %s", s.config.path)
+}
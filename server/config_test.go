@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadKeepsAuthUnlessDisabled(t *testing.T) {
+	for _, k := range reloadableEnv {
+		t.Setenv(k, "")
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(body string) {
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{config: &configSource{path: path, fromEnv: map[string]bool{}}, members: make(map[string]*member), links: make(map[string]*peerLink)}
+	write(`{"auth": {"tokens": [{"token": "t", "perms": ["publish"]}]}}`)
+	s.limits.Store(&limits{})
+	s.reloadConfig()
+	if s.auth.Load() == nil {
+		t.Fatal("auth block not applied")
+	}
+
+	write(`{}`)
+	s.reloadConfig()
+	if s.auth.Load() == nil {
+		t.Fatal("reload without an auth block opened every channel")
+	}
+	if os.Getenv("AUTH_TOKENS") == "" {
+		t.Fatal("refused reload did not restore the environment")
+	}
+
+	write(`{"auth": {"disabled": true, "secret": "s"}}`)
+	s.reloadConfig()
+	if s.auth.Load() == nil {
+		t.Fatal("conflicting auth block applied")
+	}
+
+	write(`{"auth": {"disabled": true}}`)
+	s.reloadConfig()
+	if s.auth.Load() != nil {
+		t.Fatal("auth.disabled did not turn auth off")
+	}
+}
+
+func TestFileConfigEnv(t *testing.T) {
+	env, err := readConfig("config.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"LISTEN_ADDR":          ":8080",
+		"NODE_ID":              "node-a",
+		"PUBLIC_URL":           "https://node-a.example.com",
+		"ADMIN_TOKEN":          "change-me-admin",
+		"PEERS":                "https://node-b.example.com",
+		"CLUSTER_KEY":          "change-me-cluster-key-v2",
+		"CLUSTER_KEY_VERSION":  "2",
+		"CLUSTER_KEYS":         "1:change-me-cluster-key-v1",
+		"CLUSTER_KEYS_GRACE":   "24h",
+		"CLUSTER_ACCEPT_JOIN":  "true",
+		"PEER_ENCRYPTION":      "true",
+		"REPLAY_MAX":           "200",
+		"REPLAY_MAX_AGE":       "10m",
+		"STORE_DIR":            "data",
+		"STORE_MAX_BYTES":      "10GB",
+		"STORE_MAX_AGE":        "720h",
+		"STORE_RETENTION":      "/audit/**::8760h",
+		"AUTH_SECRET":          "change-me-token-secret",
+		"AUTH_TOKENS":          "change-me-publisher=publish@/logs/**;change-me-viewer=subscribe",
+		"RATE_LIMIT_IDENTITY":  "100/s:200",
+		"RATE_LIMIT_IP":        "50/s",
+		"QUOTA_DAILY_MESSAGES": "1000000",
+		"QUOTA_DAILY_BYTES":    "1GB",
+		"MAX_CHANNELS":         "10000",
+		"BACKPRESSURE":         "/audit/**=block:250ms",
+	}
+	for k, v := range want {
+		if env[k] != v {
+			t.Errorf("%s = %q, want %q", k, env[k], v)
+		}
+	}
+	for k := range env {
+		if _, ok := want[k]; !ok {
+			t.Errorf("unexpected %s = %q", k, env[k])
+		}
+	}
+	// the flattened values parse as the server reads them
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	if a, err := authFromEnv(); err != nil || a == nil || len(a.static) != 2 {
+		t.Fatalf("authFromEnv from config: %v, %v", a, err)
+	}
+	if _, err := keyringFromEnv(); err != nil {
+		t.Fatalf("keyringFromEnv from config: %v", err)
+	}
+	if _, err := limitsFromEnv(); err != nil {
+		t.Fatalf("limitsFromEnv from config: %v", err)
+	}
+	if _, err := policiesFromEnv(); err != nil {
+		t.Fatalf("policiesFromEnv from config: %v", err)
+	}
+}
+
+func TestFileConfigEnvRejects(t *testing.T) {
+	cases := map[string]string{
+		"duration":          `{"shutdownTimeout": "soon"}`,
+		"negative duration": `{"replay": {"maxAge": "-1m"}}`,
+		"size":              `{"store": {"maxBytes": "lots"}}`,
+		"rate":              `{"limits": {"ip": "fast"}}`,
+		"negative count":    `{"replay": {"max": -1}}`,
+		"tls pair":          `{"tls": {"certFile": "c.pem"}}`,
+		"key version":       `{"cluster": {"keyVersion": -1}}`,
+		"older key version": `{"cluster": {"keyVersion": 2, "olderKeys": {"2": "k"}}}`,
+		"older key entry":   `{"cluster": {"olderKeys": {"x": "k"}}}`,
+		"token":             `{"auth": {"tokens": [{"token": "a;b", "perms": ["publish"]}]}}`,
+		"perms":             `{"auth": {"tokens": [{"token": "t"}]}}`,
+		"perm":              `{"auth": {"tokens": [{"token": "t", "perms": ["root"]}]}}`,
+		"auth disabled":     `{"auth": {"disabled": true, "secret": "s"}}`,
+		"retention":         `{"store": {"retention": [{"pattern": "/x", "maxBytes": "big"}]}}`,
+		"backpressure":      `{"limits": {"backpressure": [{"pattern": "/x", "mode": "block"}]}}`,
+		"unknown field":     `{"listen": ":80", "lisen": ":81"}`,
+	}
+	for name, body := range cases {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readConfig(path); err == nil {
+			t.Errorf("%s: %s accepted", name, body)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errDuplicate reports an envelope whose _meta.id was already published; callers
+// treat it as success so retries stay idempotent.
+var errDuplicate = errors.New("duplicate envelope")
+
+// dedupCache remembers recently published _meta.id values, bounded by count and age.
+type dedupCache struct {
+	mu    sync.Mutex
+	cap   int
+	ttl   time.Duration
+	order *list.List // of dedupEntry, oldest at the front
+	index map[string]*list.Element
+
+	fromClients, fromPeers atomic.Int64
+}
+
+type dedupEntry struct {
+	id string
+	at time.Time
+}
+
+// dedupStats is the JSON view served by /_cluster/stats.
+type dedupStats struct {
+	Size        int   `json:"size"`
+	FromClients int64 `json:"suppressedFromClients"`
+	FromPeers   int64 `json:"suppressedFromPeers"`
+}
+
+func newDedupCache(capacity int, ttl time.Duration) *dedupCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &dedupCache{cap: capacity, ttl: ttl, order: list.New(), index: make(map[string]*list.Element)}
+}
+
+// seen records id and reports whether it was already recorded within the TTL.
+func (d *dedupCache) seen(id string, fromPeer bool) bool {
+	if d == nil || id == "" {
+		return false
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(now)
+	if _, ok := d.index[id]; ok {
+		if fromPeer {
+			d.fromPeers.Add(1)
+		} else {
+			d.fromClients.Add(1)
+		}
+		return true
+	}
+	d.index[id] = d.order.PushBack(dedupEntry{id: id, at: now})
+	for d.order.Len() > d.cap {
+		d.remove(d.order.Front())
+	}
+	return false
+}
+
+func (d *dedupCache) expire(now time.Time) {
+	if d.ttl <= 0 {
+		return
+	}
+	for e := d.order.Front(); e != nil && now.Sub(e.Value.(dedupEntry).at) > d.ttl; e = d.order.Front() {
+		d.remove(e)
+	}
+}
+
+func (d *dedupCache) remove(e *list.Element) {
+	delete(d.index, e.Value.(dedupEntry).id)
+	d.order.Remove(e)
+}
+
+func (d *dedupCache) stats() dedupStats {
+	if d == nil {
+		return dedupStats{}
+	}
+	d.mu.Lock()
+	n := d.order.Len()
+	d.mu.Unlock()
+	return dedupStats{Size: n, FromClients: d.fromClients.Load(), FromPeers: d.fromPeers.Load()}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupCache(t *testing.T) {
+	d := newDedupCache(3, time.Hour)
+	for _, id := range []string{"a", "b", "c"} {
+		if d.seen(id, false) {
+			t.Fatalf("%s seen before it was recorded", id)
+		}
+	}
+	if !d.seen("a", false) || !d.seen("b", true) || !d.seen("c", true) {
+		t.Fatal("recorded id not seen")
+	}
+	if st := d.stats(); st.Size != 3 || st.FromClients != 1 || st.FromPeers != 2 {
+		t.Fatalf("stats = %+v, want size 3, 1 from clients, 2 from peers", st)
+	}
+	// at capacity the oldest id goes
+	d.seen("d", false)
+	if d.seen("a", false) {
+		t.Fatal("oldest id kept past capacity")
+	}
+	if !d.seen("d", false) {
+		t.Fatal("newest id evicted")
+	}
+	if d.seen("", true) || d.seen("", true) {
+		t.Fatal("empty id deduplicated")
+	}
+	var none *dedupCache
+	if newDedupCache(0, time.Hour) != nil || none.seen("x", false) || none.seen("x", false) {
+		t.Fatal("disabled cache deduplicates")
+	}
+}
+
+func TestDedupCacheTTL(t *testing.T) {
+	d := newDedupCache(10, 20*time.Millisecond)
+	d.seen("a", false)
+	time.Sleep(10 * time.Millisecond)
+	d.seen("b", false)
+	time.Sleep(15 * time.Millisecond)
+	if d.seen("a", true) {
+		t.Fatal("id seen after its TTL")
+	}
+	if !d.seen("b", true) {
+		t.Fatal("id forgotten within its TTL")
+	}
+	if st := d.stats(); st.Size != 2 || st.FromPeers != 1 || st.FromClients != 0 {
+		t.Fatalf("stats = %+v, want a and b recorded and one peer duplicate", st)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// subFilter is a per-subscriber filter evaluated by the hub before queuing a message:
+//
+//	?level=error,warn            keep messages whose "level" is one of these
+//	?where=status_code>=500      keep messages where the condition holds (repeatable)
+//	?fields=title,message        forward only these top-level fields (plus _meta)
+type subFilter struct {
+	levels map[string]bool
+	conds  []condition
+	fields []string
+}
+
+type condition struct {
+	path  []string
+	op    string
+	val   string
+	num   float64
+	isNum bool
+}
+
+// at each position two-character operators are tried before one-character ones.
+var conditionOps = []string{">=", "<=", "!=", "==", "=", ">", "<", "~"}
+
+func parseSubFilter(q url.Values) (*subFilter, error) {
+	f := &subFilter{}
+	for _, v := range q["level"] {
+		for _, l := range strings.Split(v, ",") {
+			if l = strings.ToLower(strings.TrimSpace(l)); l != "" {
+				if f.levels == nil {
+					f.levels = make(map[string]bool)
+				}
+				f.levels[l] = true
+			}
+		}
+	}
+	for _, v := range q["where"] {
+		c, err := parseCondition(v)
+		if err != nil {
+			return nil, err
+		}
+		f.conds = append(f.conds, c)
+	}
+	for _, v := range q["fields"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" && name != "_meta" {
+				f.fields = append(f.fields, name)
+			}
+		}
+	}
+	if f.levels == nil && f.conds == nil && f.fields == nil {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func parseCondition(expr string) (condition, error) {
+	for i := 1; i < len(expr); i++ {
+		op := ""
+		for _, o := range conditionOps {
+			if strings.HasPrefix(expr[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			continue
+		}
+		c := condition{
+			path: strings.Split(strings.TrimSpace(expr[:i]), "."),
+			op:   op,
+			val:  strings.TrimSpace(expr[i+len(op):]),
+		}
+		if c.op == "==" {
+			c.op = "="
+		}
+		if n, err := strconv.ParseFloat(c.val, 64); err == nil {
+			c.num, c.isNum = n, true
+		}
+		return c, nil
+	}
+	return condition{}, fmt.Errorf("invalid where %q", expr)
+}
+
+func (c condition) match(doc map[string]any) bool {
+	v, ok := lookupPath(doc, c.path)
+	if !ok {
+		return c.op == "!="
+	}
+	if c.op == "~" {
+		return strings.Contains(strings.ToLower(fmt.Sprint(v)), strings.ToLower(c.val))
+	}
+	if num, ok := v.(json.Number); ok && c.isNum {
+		n, _ := num.Float64()
+		switch c.op {
+		case "=":
+			return n == c.num
+		case "!=":
+			return n != c.num
+		case ">":
+			return n > c.num
+		case ">=":
+			return n >= c.num
+		case "<":
+			return n < c.num
+		case "<=":
+			return n <= c.num
+		}
+	}
+	s := fmt.Sprint(v)
+	switch c.op {
+	case "=":
+		return s == c.val
+	case "!=":
+		return s != c.val
+	case ">":
+		return s > c.val
+	case ">=":
+		return s >= c.val
+	case "<":
+		return s < c.val
+	case "<=":
+		return s <= c.val
+	}
+	return false
+}
+
+func lookupPath(doc map[string]any, path []string) (any, bool) {
+	var cur any = doc
+	for _, p := range path {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[p]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// apply returns the message to deliver and whether it passes the filter.
+// doc is the decoded message, nil if it is not a JSON object.
+func (f *subFilter) apply(doc map[string]any, raw []byte) ([]byte, bool) {
+	if doc == nil {
+		return raw, f.levels == nil && f.conds == nil
+	}
+	if f.levels != nil {
+		l, _ := doc["level"].(string)
+		if !f.levels[strings.ToLower(l)] {
+			return nil, false
+		}
+	}
+	for _, c := range f.conds {
+		if !c.match(doc) {
+			return nil, false
+		}
+	}
+	if f.fields == nil {
+		return raw, true
+	}
+	out := make(map[string]any, len(f.fields)+1)
+	if m, ok := doc["_meta"]; ok {
+		out["_meta"] = m
+	}
+	for _, name := range f.fields {
+		if v, ok := doc[name]; ok {
+			out[name] = v
+		}
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// decodeObject decodes msg for filtering, returning nil for non-objects.
+// Numbers stay json.Number so projected messages keep _meta.unixNs exact.
+func decodeObject(msg []byte) map[string]any {
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return nil
+	}
+	return doc
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseSubFilter(t *testing.T) {
+	cases := []struct {
+		query   string
+		wantErr bool
+		wantNil bool
+		msg     string
+		pass    bool
+		out     string // expected projection, when fields are set
+	}{
+		{query: "", wantNil: true},
+		{query: "level=", wantNil: true},
+		{query: "level=error,WARN", msg: `{"level":"warn"}`, pass: true},
+		{query: "level=error", msg: `{"level":"info"}`, pass: false},
+		{query: "level=error", msg: `{"message":"no level"}`, pass: false},
+		{query: "where=status>=500", msg: `{"status":503}`, pass: true},
+		{query: "where=status>=500", msg: `{"status":404}`, pass: false},
+		{query: "where=status>=500", msg: `{"status":"600"}`, pass: true},
+		{query: "where=status==200", msg: `{"status":200.0}`, pass: true},
+		{query: "where=status!=200", msg: `{"other":1}`, pass: true},
+		{query: "where=user.name=bob", msg: `{"user":{"name":"bob"}}`, pass: true},
+		{query: "where=user.name=bob", msg: `{"user":"bob"}`, pass: false},
+		{query: "where=message~TIMEOUT", msg: `{"message":"upstream timeout"}`, pass: true},
+		{query: "where=a>1&where=b<1", msg: `{"a":2,"b":2}`, pass: false},
+		{query: "where=noop", wantErr: true},
+		{query: "where==5", wantErr: true},
+		{query: "fields=title,_meta", msg: `{"title":"t","body":"b","_meta":{"id":"x"}}`, pass: true, out: `{"_meta":{"id":"x"},"title":"t"}`},
+		{query: "level=error", msg: `"scalar"`, pass: false},
+		{query: "fields=title", msg: `"scalar"`, pass: true, out: `"scalar"`},
+	}
+	for _, tc := range cases {
+		q, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := parseSubFilter(q)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.query, err)
+			continue
+		}
+		if tc.wantNil {
+			if f != nil {
+				t.Errorf("%q: expected no filter", tc.query)
+			}
+			continue
+		}
+		out, ok := f.apply(decodeObject([]byte(tc.msg)), []byte(tc.msg))
+		if ok != tc.pass {
+			t.Errorf("%q on %s: pass = %v, want %v", tc.query, tc.msg, ok, tc.pass)
+			continue
+		}
+		if tc.out != "" && string(out) != tc.out {
+			t.Errorf("%q on %s: got %s, want %s", tc.query, tc.msg, out, tc.out)
+		}
+	}
+}
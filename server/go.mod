@@ -5,5 +5,6 @@ go 1.22
 require (
 	github.com/go-chi/chi/v5 v5.0.10
 	github.com/gofrs/uuid/v5 v5.2.0
+	github.com/klauspost/compress v1.18.0
 	nhooyr.io/websocket v1.8.17
 )
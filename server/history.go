@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	historyDefaultLimit = 100
+	historyMaxLimit     = 1000
+)
+
+type historyQuery struct {
+	fromNs, toNs int64
+	afterNs      int64
+	afterID      string
+	limit        int
+}
+
+type storedEnvelope struct {
+	id     string
+	unixNs int64
+	raw    []byte
+}
+
+func (e storedEnvelope) after(ns int64, id string) bool {
+	return e.unixNs > ns || (e.unixNs == ns && e.id > id)
+}
+
+// Query returns up to q.limit stored envelopes of channel ordered by (_meta.unixNs, _meta.id).
+// Sealed segments outside the requested range are skipped by their recorded
+// bounds; the open segment is always read.
+func (st *Store) Query(channel string, q historyQuery) ([]storedEnvelope, error) {
+	dir := st.channelDir(channel)
+	segs, err := listSegments(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	lo := max(q.fromNs, q.afterNs)
+	var out []storedEnvelope
+	for _, seg := range segs {
+		if seg.sealed {
+			if seg.maxNs < lo || seg.minNs > q.toNs {
+				continue
+			}
+			// a full page only changes for envelopes at or before its last one
+			if len(out) == q.limit && seg.minNs > out[len(out)-1].unixNs {
+				continue
+			}
+		}
+		keep := func(e storedEnvelope) {
+			if e.unixNs < q.fromNs || e.unixNs > q.toNs || !e.after(q.afterNs, q.afterID) {
+				return
+			}
+			out = append(out, e)
+		}
+		err := scanSegment(filepath.Join(dir, seg.name), keep)
+		if err == errSegmentGone && !seg.sealed {
+			// sealed meanwhile: read it under its new name
+			if sealed, ok := findSegment(dir, seg.startNs); ok {
+				err = scanSegment(filepath.Join(dir, sealed), keep)
+			}
+		}
+		if err != nil && err != errSegmentGone {
+			return nil, err
+		}
+		sortEnvelopes(out)
+		if len(out) > q.limit {
+			out = out[:q.limit]
+		}
+	}
+	return out, nil
+}
+
+// findSegment returns the current name of the segment opened at startNs.
+func findSegment(dir string, startNs int64) (string, bool) {
+	segs, err := listSegments(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, seg := range segs {
+		if seg.startNs == startNs {
+			return seg.name, true
+		}
+	}
+	return "", false
+}
+
+func sortEnvelopes(es []storedEnvelope) {
+	sort.Slice(es, func(i, j int) bool {
+		if es[i].unixNs != es[j].unixNs {
+			return es[i].unixNs < es[j].unixNs
+		}
+		return es[i].id < es[j].id
+	})
+}
+
+var errSegmentGone = errors.New("segment gone")
+
+func scanSegment(path string, fn func(storedEnvelope)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// sealed or removed by retention while we were listing
+			return errSegmentGone
+		}
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 2<<20)
+	for sc.Scan() {
+		m, ok := parseMeta(sc.Bytes())
+		if !ok {
+			// partial trailing line of the active segment
+			continue
+		}
+		fn(storedEnvelope{id: m.ID, unixNs: m.UnixNs, raw: append([]byte(nil), sc.Bytes()...)})
+	}
+	return sc.Err()
+}
+
+// history serves GET /_history/{channel}?from=&to=&limit=&cursor= as NDJSON.
+// The next page's cursor is returned in X-Next-Cursor when the page is full.
+func (s *Server) history(w http.ResponseWriter, r *http.Request) {
+	if s.store == nil {
+		http.Error(w, "history not enabled", http.StatusNotImplemented)
+		return
+	}
+	channel := "/" + strings.Trim(chi.URLParam(r, "*"), "/")
+	if channel == "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if s.authorize(w, r, permSubscribe, channel) == nil {
+		return
+	}
+	q, err := parseHistoryQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := s.store.Query(channel, q)
+	if err != nil {
+		http.Error(w, "history read error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if len(page) == q.limit {
+		last := page[len(page)-1]
+		w.Header().Set("X-Next-Cursor", encodeCursor(last.unixNs, last.id))
+	}
+	bw := bufio.NewWriter(w)
+	for _, e := range page {
+		_, _ = bw.Write(e.raw)
+		_ = bw.WriteByte('\n')
+	}
+	_ = bw.Flush()
+}
+
+func parseHistoryQuery(r *http.Request) (historyQuery, error) {
+	v := r.URL.Query()
+	q := historyQuery{toNs: math.MaxInt64, afterNs: math.MinInt64, limit: historyDefaultLimit}
+	var err error
+	if s := v.Get("from"); s != "" {
+		if q.fromNs, err = parseTimeParam(s); err != nil {
+			return q, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		if q.toNs, err = parseTimeParam(s); err != nil {
+			return q, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return q, fmt.Errorf("invalid limit")
+		}
+		q.limit = min(n, historyMaxLimit)
+	}
+	if s := v.Get("cursor"); s != "" {
+		if q.afterNs, q.afterID, err = decodeCursor(s); err != nil {
+			return q, fmt.Errorf("invalid cursor")
+		}
+	}
+	return q, nil
+}
+
+// parseTimeParam accepts RFC3339 or a unix timestamp in nanoseconds.
+func parseTimeParam(s string) (int64, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UnixNano(), nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func encodeCursor(ns int64, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(ns, 10) + ":" + id))
+}
+
+func decodeCursor(c string) (int64, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return 0, "", err
+	}
+	nsPart, id, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return 0, "", fmt.Errorf("malformed cursor")
+	}
+	ns, err := strconv.ParseInt(nsPart, 10, 64)
+	return ns, id, err
+}
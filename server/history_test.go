@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestStoreQueryPaging(t *testing.T) {
+	st, err := OpenStore(t.TempDir(), 200, 0, retentionPolicy{pattern: "/**"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	var all []storedEnvelope
+	for i := 0; i < 60; i++ {
+		ns := base + int64(i)*int64(10*time.Second)
+		if i%7 == 3 {
+			// a late envelope from a peer, older than the segment it lands in
+			ns -= int64(40 * time.Second)
+		}
+		if i%11 == 5 {
+			// same timestamp as its predecessor: ordered by id
+			ns = all[len(all)-1].unixNs
+		}
+		id := fmt.Sprintf("id-%02d", i)
+		if err := st.Append("/logs/app", []byte(fmt.Sprintf(`{"_meta":{"id":%q,"unixNs":%d}}`, id, ns)), ns); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, storedEnvelope{id: id, unixNs: ns})
+	}
+	sortEnvelopes(all)
+
+	for _, limit := range []int{1, 5, 7, 60, 100} {
+		q := historyQuery{toNs: math.MaxInt64, afterNs: math.MinInt64, limit: limit}
+		var got []storedEnvelope
+		for pages := 0; ; pages++ {
+			if pages > len(all)+1 {
+				t.Fatalf("limit %d: paging does not terminate", limit)
+			}
+			page, err := st.Query("/logs/app", q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, page...)
+			if len(page) < limit {
+				break
+			}
+			last := page[len(page)-1]
+			q.afterNs, q.afterID = last.unixNs, last.id
+		}
+		if len(got) != len(all) {
+			t.Fatalf("limit %d: got %d envelopes, want %d", limit, len(got), len(all))
+		}
+		for i := range all {
+			if got[i].id != all[i].id || got[i].unixNs != all[i].unixNs {
+				t.Fatalf("limit %d: envelope %d = %s@%d, want %s@%d", limit, i, got[i].id, got[i].unixNs, all[i].id, all[i].unixNs)
+			}
+		}
+	}
+
+	from, to := all[10].unixNs, all[20].unixNs
+	page, err := st.Query("/logs/app", historyQuery{fromNs: from, toNs: to, afterNs: math.MinInt64, limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 0
+	for _, e := range all {
+		if e.unixNs >= from && e.unixNs <= to {
+			want++
+		}
+	}
+	if len(page) != want || !sort.SliceIsSorted(page, func(i, j int) bool { return page[i].unixNs < page[j].unixNs }) {
+		t.Fatalf("range query returned %d envelopes, want %d in order", len(page), want)
+	}
+
+	if page, err := st.Query("/logs/missing", historyQuery{toNs: math.MaxInt64, limit: 10}); err != nil || page != nil {
+		t.Fatalf("missing channel: %v, %v", page, err)
+	}
+}
+
+func TestStoreQueryOutOfOrderSegments(t *testing.T) {
+	dir := t.TempDir()
+	st, err := OpenStore(dir, 150, 0, retentionPolicy{pattern: "/**"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	var all []int64
+	for i := 0; i < 40; i++ {
+		// with the envelope window off, stored ts can be any age
+		ns := base + int64(i)*int64(time.Second)
+		switch i % 4 {
+		case 1:
+			ns -= int64(48 * time.Hour)
+		case 3:
+			ns += int64(48 * time.Hour)
+		}
+		if err := st.Append("/c", []byte(fmt.Sprintf(`{"_meta":{"id":"id-%02d","unixNs":%d}}`, i, ns)), ns); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, ns)
+	}
+	count := func(from, to int64) int {
+		n := 0
+		for _, ns := range all {
+			if ns >= from && ns <= to {
+				n++
+			}
+		}
+		return n
+	}
+	check := func(stage string) {
+		for _, r := range [][2]int64{
+			{math.MinInt64, base + int64(20*time.Second)},
+			{base - int64(47*time.Hour), base + int64(47*time.Hour)},
+			{base + int64(time.Hour), math.MaxInt64},
+			{math.MinInt64, math.MaxInt64},
+		} {
+			page, err := st.Query("/c", historyQuery{fromNs: r[0], toNs: r[1], afterNs: math.MinInt64, limit: 100})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := count(r[0], r[1]); len(page) != want {
+				t.Errorf("%s: query [%d, %d] returned %d envelopes, want %d", stage, r[0], r[1], len(page), want)
+			}
+		}
+	}
+	check("open")
+	st.Close()
+	segs, err := listSegments(st.channelDir("/c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seg := range segs {
+		if !seg.sealed {
+			t.Fatalf("segment %s not sealed on close", seg.name)
+		}
+	}
+	check("sealed")
+
+	// a segment left open by a crash is read until cleanup seals it
+	leftover := filepath.Join(st.channelDir("/c"), fmt.Sprintf("%020d%s", time.Now().UnixNano(), segmentExt))
+	line := fmt.Sprintf(`{"_meta":{"id":"id-late","unixNs":%d}}`+"\n", base-int64(72*time.Hour))
+	if err := os.WriteFile(leftover, []byte(line), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	all = append(all, base-int64(72*time.Hour))
+	check("leftover")
+	st.cleanup()
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatalf("leftover segment not sealed: %v", err)
+	}
+	check("leftover sealed")
+}
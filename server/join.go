@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	joinTokenTTL    = 10 * time.Minute
+	joinTokenMaxTTL = 24 * time.Hour
+	joinKDFLabel    = "loghud-join-v1"
+)
+
+// joinRequest is the body of POST /_cluster/join. PublicKey is a base64 X25519 key.
+type joinRequest struct {
+	NodeID    string `json:"nodeId"`
+	Address   string `json:"address"`
+	PublicKey string `json:"publicKey"`
+	JoinToken string `json:"joinToken"`
+}
+
+// sealedKey is the cluster key encrypted to the joining node's public key:
+// AES-256-GCM under SHA-256(X25519(ephemeral, node) || label).
+type sealedKey struct {
+	EphemeralKey string `json:"ephemeralKey"`
+	Nonce        string `json:"nonce"`
+	Ciphertext   string `json:"ciphertext"`
+}
+
+type joinResponse struct {
+	Members    []member  `json:"members"`
+	KeyVersion int       `json:"keyVersion"`
+	ClusterKey sealedKey `json:"clusterKey"`
+	// retired versions still accepted for verification
+	OlderKeys []joinKey `json:"olderKeys,omitempty"`
+}
+
+type joinKey struct {
+	Version int       `json:"version"`
+	Expires time.Time `json:"expiresAt,omitempty"`
+	Key     sealedKey `json:"key"`
+}
+
+// isAdmin accepts ADMIN_TOKEN or a client token carrying the admin permission.
+func (s *Server) isAdmin(r *http.Request) bool {
+	tok := bearerToken(r)
+	if s.admin != "" && tok != "" && subtle.ConstantTimeCompare([]byte(tok), []byte(s.admin)) == 1 {
+		return true
+	}
+	if s.auth.Load() == nil || tok == "" {
+		return false
+	}
+	p, err := s.authenticate(r)
+	return err == nil && slices.Contains(p.Perms, permAdmin)
+}
+
+// mintJoinToken serves POST /_cluster/join-tokens?ttl=10m for admins.
+func (s *Server) mintJoinToken(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ttl := joinTokenTTL
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > joinTokenMaxTTL {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, "token error", http.StatusInternalServerError)
+		return
+	}
+	tok := base64.RawURLEncoding.EncodeToString(raw)
+	exp := time.Now().Add(ttl)
+	s.clusterMu.Lock()
+	for t, e := range s.joinTokens {
+		if time.Now().After(e) {
+			delete(s.joinTokens, t)
+		}
+	}
+	s.joinTokens[tok] = exp
+	s.clusterMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"joinToken": tok, "expiresAt": exp.UTC().Format(time.RFC3339)})
+}
+
+// redeemJoinToken consumes tok, reporting whether it was valid and unexpired.
+func (s *Server) redeemJoinToken(tok string) bool {
+	s.clusterMu.Lock()
+	defer s.clusterMu.Unlock()
+	exp, ok := s.joinTokens[tok]
+	if !ok {
+		return false
+	}
+	delete(s.joinTokens, tok)
+	return time.Now().Before(exp)
+}
+
+// clusterJoin serves POST /_cluster/join: a new node trades a one-time join
+// token for the member list and the cluster key sealed to its public key.
+func (s *Server) clusterJoin(w http.ResponseWriter, r *http.Request) {
+	if s.refuseDemoKey(w) {
+		return
+	}
+	if !s.acceptJoin {
+		http.Error(w, "joins disabled", http.StatusForbidden)
+		return
+	}
+	var req joinRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	req.Address = normalizeAddress(req.Address)
+	if req.NodeID == "" || req.Address == "" || req.PublicKey == "" {
+		http.Error(w, "nodeId, address and publicKey are required", http.StatusBadRequest)
+		return
+	}
+	if req.NodeID == s.nodeID {
+		http.Error(w, "nodeId already in use", http.StatusConflict)
+		return
+	}
+	if !s.redeemJoinToken(req.JoinToken) {
+		http.Error(w, "invalid or expired join token", http.StatusForbidden)
+		return
+	}
+	ver, key := s.keys.signing()
+	sealed, err := sealForPeer(req.PublicKey, key)
+	if err != nil {
+		http.Error(w, "invalid publicKey", http.StatusBadRequest)
+		return
+	}
+	resp := joinResponse{Members: s.memberList(), KeyVersion: ver, ClusterKey: *sealed}
+	for _, k := range s.keys.retired() {
+		if sk, err := sealForPeer(req.PublicKey, k.key); err == nil {
+			resp.OlderKeys = append(resp.OlderKeys, joinKey{Version: k.version, Expires: k.expires, Key: *sk})
+		}
+	}
+	log.Printf("cluster: %s joined from %s", req.NodeID, req.Address)
+	// everyone else hears about the new node through Members gossip
+	s.learnMembers([]member{{NodeID: req.NodeID, Address: req.Address, PublicKey: req.PublicKey, Updated: time.Now().UnixNano()}})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// joinCluster redeems token at joinURL, adopts the returned cluster keys and
+// returns the members to connect to. PUBLIC_URL must be set so peers can dial back.
+// It runs before startCluster so no stream uses the key while it changes.
+func (s *Server) joinCluster(ctx context.Context, joinURL, token string) ([]member, error) {
+	if s.publicURL == "" {
+		return nil, fmt.Errorf("PUBLIC_URL is required to join a cluster")
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(joinRequest{
+		NodeID:    s.nodeID,
+		Address:   s.publicURL,
+		PublicKey: base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()),
+		JoinToken: token,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, normalizeAddress(joinURL)+"/_cluster/join", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.httpc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("join rejected: %s", resp.Status)
+	}
+	var jr joinResponse
+	if err := json.NewDecoder(resp.Body).Decode(&jr); err != nil {
+		return nil, fmt.Errorf("decode join response: %w", err)
+	}
+	key, err := openFromPeer(priv, jr.ClusterKey)
+	if err != nil {
+		return nil, fmt.Errorf("open cluster key: %w", err)
+	}
+	kr := newKeyring(jr.KeyVersion, key)
+	for _, k := range jr.OlderKeys {
+		old, err := openFromPeer(priv, k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("open cluster key %d: %w", k.Version, err)
+		}
+		kr.add(k.Version, old, k.Expires)
+	}
+	s.keys = kr
+	log.Printf("cluster: joined via %s with %d members", joinURL, len(jr.Members))
+	// the node we joined through may not advertise itself in the list
+	return append(jr.Members, member{Address: joinURL}), nil
+}
+
+func joinAEAD(shared []byte) (cipher.AEAD, error) {
+	k := sha256.Sum256(append(shared, joinKDFLabel...))
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealForPeer(pubB64 string, secret []byte) (*sealedKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(pubB64)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := joinAEAD(shared)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &sealedKey{
+		EphemeralKey: base64.StdEncoding.EncodeToString(eph.PublicKey().Bytes()),
+		Nonce:        base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext:   base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, secret, nil)),
+	}, nil
+}
+
+func openFromPeer(priv *ecdh.PrivateKey, sk sealedKey) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(sk.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := joinAEAD(shared)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(sk.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := base64.StdEncoding.DecodeString(sk.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("bad nonce")
+	}
+	return aead.Open(nil, nonce, ct, nil)
+}
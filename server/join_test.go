@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestSealForPeer(t *testing.T) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes())
+	secret := []byte("cluster-key")
+	sk, err := sealForPeer(pub, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sk.Ciphertext, base64.StdEncoding.EncodeToString(secret)) {
+		t.Fatal("sealed key carries the plaintext")
+	}
+	got, err := openFromPeer(priv, *sk)
+	if err != nil || string(got) != string(secret) {
+		t.Fatalf("openFromPeer = %q, %v; want %q", got, err, secret)
+	}
+
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if _, err := openFromPeer(other, *sk); err == nil {
+		t.Fatal("another node's key opened the sealed key")
+	}
+	flip := func(s string) string {
+		b, _ := base64.StdEncoding.DecodeString(s)
+		b[len(b)-1] ^= 1
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	tamper := map[string]func(*sealedKey){
+		"ciphertext":    func(k *sealedKey) { k.Ciphertext = flip(k.Ciphertext) },
+		"nonce":         func(k *sealedKey) { k.Nonce = flip(k.Nonce) },
+		"ephemeral key": func(k *sealedKey) { k.EphemeralKey = flip(k.EphemeralKey) },
+		"short nonce":   func(k *sealedKey) { k.Nonce = base64.StdEncoding.EncodeToString([]byte("short")) },
+		"not base64":    func(k *sealedKey) { k.Ciphertext = "%%%" },
+	}
+	for name, mod := range tamper {
+		k := *sk
+		mod(&k)
+		if _, err := openFromPeer(priv, k); err == nil {
+			t.Errorf("tampered %s opened", name)
+		}
+	}
+
+	for _, bad := range []string{"", "%%%", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := sealForPeer(bad, secret); err == nil {
+			t.Errorf("sealForPeer(%q) accepted an invalid public key", bad)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// demoClusterKey is the built-in development key; cluster mode refuses it.
+const demoClusterKey = "dev-demo-key-please-change"
+
+// keyGrace is how long a replaced signing key is still accepted by default.
+const keyGrace = 24 * time.Hour
+
+type clusterKey struct {
+	version int
+	key     []byte
+	expires time.Time // zero while active or when it never expires
+}
+
+// keyring holds the cluster key versions: one active for signing, older ones
+// accepted for verification until they expire.
+type keyring struct {
+	mu     sync.RWMutex
+	keys   map[int]*clusterKey
+	active int
+}
+
+func newKeyring(version int, key []byte) *keyring {
+	return &keyring{keys: map[int]*clusterKey{version: {version: version, key: key}}, active: version}
+}
+
+// signing returns the active version and key.
+func (kr *keyring) signing() (int, []byte) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.active, kr.keys[kr.active].key
+}
+
+// lookup returns the key for version, or nil if unknown or expired.
+func (kr *keyring) lookup(version int) []byte {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	k, ok := kr.keys[version]
+	if !ok || (!k.expires.IsZero() && time.Now().After(k.expires)) {
+		return nil
+	}
+	return k.key
+}
+
+// valid returns every unexpired key, active first.
+func (kr *keyring) valid() [][]byte {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	out := [][]byte{kr.keys[kr.active].key}
+	now := time.Now()
+	for v, k := range kr.keys {
+		if v != kr.active && (k.expires.IsZero() || now.Before(k.expires)) {
+			out = append(out, k.key)
+		}
+	}
+	return out
+}
+
+// retired returns copies of the unexpired keys other than the active one.
+func (kr *keyring) retired() []clusterKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	var out []clusterKey
+	now := time.Now()
+	for v, k := range kr.keys {
+		if v != kr.active && (k.expires.IsZero() || now.Before(k.expires)) {
+			out = append(out, *k)
+		}
+	}
+	return out
+}
+
+// add installs a key version unless it is already known.
+func (kr *keyring) add(version int, key []byte, expires time.Time) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, ok := kr.keys[version]; !ok {
+		kr.keys[version] = &clusterKey{version: version, key: key, expires: expires}
+	}
+}
+
+// setExpiry adopts expires for a known, inactive version.
+func (kr *keyring) setExpiry(version int, expires time.Time) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if k, ok := kr.keys[version]; ok && version != kr.active {
+		k.expires = expires
+	}
+}
+
+// activate switches signing to version, retiring the previous key after grace.
+// Older versions are ignored so gossip cannot roll the ring back.
+func (kr *keyring) activate(version int, grace time.Duration) bool {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, ok := kr.keys[version]; !ok || version <= kr.active {
+		return false
+	}
+	kr.keys[kr.active].expires = time.Now().Add(grace)
+	kr.keys[version].expires = time.Time{}
+	kr.active = version
+	return true
+}
+
+// rotate adds a fresh random key as the next version and returns it unactivated.
+func (kr *keyring) rotate() (int, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return 0, err
+	}
+	kr.mu.Lock()
+	next := kr.active
+	for v := range kr.keys {
+		next = max(next, v)
+	}
+	next++
+	kr.keys[next] = &clusterKey{version: next, key: key}
+	kr.mu.Unlock()
+	return next, nil
+}
+
+func (kr *keyring) prune() {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	now := time.Now()
+	for v, k := range kr.keys {
+		if v != kr.active && !k.expires.IsZero() && now.After(k.expires) {
+			delete(kr.keys, v)
+		}
+	}
+}
+
+// keyInfo describes a key version without its material.
+type keyInfo struct {
+	Version int        `json:"version"`
+	Active  bool       `json:"active"`
+	Expires *time.Time `json:"expiresAt,omitempty"`
+}
+
+func (kr *keyring) info() []keyInfo {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	out := make([]keyInfo, 0, len(kr.keys))
+	for v, k := range kr.keys {
+		ki := keyInfo{Version: v, Active: v == kr.active}
+		if !k.expires.IsZero() {
+			exp := k.expires.UTC()
+			ki.Expires = &exp
+		}
+		out = append(out, ki)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out
+}
+
+// chainedKey is a key version encrypted under the previous version, so a node
+// holding any older key can walk forward to the newest one. The oldest version
+// is sent without key material, only to carry its expiry.
+type chainedKey struct {
+	Version int       `json:"version"`
+	Expires time.Time `json:"expiresAt,omitempty"`
+	Wrapped []byte    `json:"wrapped,omitempty"`
+}
+
+// keysFrame carries the key chain between nodes. Anyone holding an old key
+// could unwrap every later one, so Keys frames only travel over links whose
+// both ends are authenticated by the cluster CA.
+type keysFrame struct {
+	Active int          `json:"active"`
+	Chain  []chainedKey `json:"chain"`
+}
+
+func keyAEAD(key []byte) (cipher.AEAD, error) {
+	k := sha256.Sum256(key)
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chain wraps every key version that has a predecessor in the ring.
+func (kr *keyring) chain() keysFrame {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	out := keysFrame{Active: kr.active}
+	vers := make([]int, 0, len(kr.keys))
+	for v := range kr.keys {
+		vers = append(vers, v)
+	}
+	sort.Ints(vers)
+	if len(vers) > 0 {
+		out.Chain = append(out.Chain, chainedKey{Version: vers[0], Expires: kr.keys[vers[0]].expires})
+	}
+	for i := 1; i < len(vers); i++ {
+		prev, cur := kr.keys[vers[i-1]], kr.keys[vers[i]]
+		aead, err := keyAEAD(prev.key)
+		if err != nil {
+			continue
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			continue
+		}
+		ad := []byte(strconv.Itoa(cur.version))
+		out.Chain = append(out.Chain, chainedKey{
+			Version: cur.version,
+			Expires: cur.expires,
+			Wrapped: append(nonce, aead.Seal(nil, nonce, cur.key, ad)...),
+		})
+	}
+	return out
+}
+
+// merge unwraps the versions it can reach from keys it already holds,
+// activates f.Active once known and adopts the sender's expiries.
+func (kr *keyring) merge(f keysFrame) {
+	for _, ck := range f.Chain {
+		if kr.lookupAny(ck.Version) != nil || ck.Wrapped == nil {
+			continue
+		}
+		prev := kr.predecessor(ck.Version)
+		if prev == nil {
+			continue
+		}
+		key, err := unwrapKey(prev, ck)
+		if err != nil {
+			log.Printf("keyring: version %d: %v", ck.Version, err)
+			continue
+		}
+		kr.add(ck.Version, key, ck.Expires)
+	}
+	if kr.activate(f.Active, keyGrace) {
+		log.Printf("keyring: signing with key version %d", f.Active)
+	}
+	for _, ck := range f.Chain {
+		kr.setExpiry(ck.Version, ck.Expires)
+	}
+}
+
+func (kr *keyring) lookupAny(version int) []byte {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	if k, ok := kr.keys[version]; ok {
+		return k.key
+	}
+	return nil
+}
+
+// predecessor returns the key of the highest version below version.
+func (kr *keyring) predecessor(version int) []byte {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	best := 0
+	for v := range kr.keys {
+		if v < version && v > best {
+			best = v
+		}
+	}
+	if best == 0 {
+		return nil
+	}
+	return kr.keys[best].key
+}
+
+func unwrapKey(prev []byte, ck chainedKey) ([]byte, error) {
+	aead, err := keyAEAD(prev)
+	if err != nil {
+		return nil, err
+	}
+	if len(ck.Wrapped) < aead.NonceSize() {
+		return nil, errors.New("short wrapped key")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, ck.Wrapped[:n], ck.Wrapped[n:], []byte(strconv.Itoa(ck.Version)))
+}
+
+// keyringFromEnv builds the ring from CLUSTER_KEY/CLUSTER_KEY_VERSION, which
+// signs, plus retired versions below it in CLUSTER_KEYS ("1:secret,2:secret").
+// Retired keys verify for CLUSTER_KEYS_GRACE (default keyGrace) after start.
+func keyringFromEnv() (*keyring, error) {
+	key := []byte(os.Getenv("CLUSTER_KEY"))
+	if len(key) == 0 {
+		key = []byte(demoClusterKey)
+	}
+	ver := 1
+	if v := os.Getenv("CLUSTER_KEY_VERSION"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid CLUSTER_KEY_VERSION %q", v)
+		}
+		ver = n
+	}
+	kr := newKeyring(ver, key)
+	expires := time.Now().Add(durationEnv("CLUSTER_KEYS_GRACE", keyGrace))
+	for _, part := range strings.Split(os.Getenv("CLUSTER_KEYS"), ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		vs, secret, ok := strings.Cut(part, ":")
+		n, err := strconv.Atoi(vs)
+		if !ok || err != nil || n <= 0 || secret == "" {
+			return nil, fmt.Errorf("invalid CLUSTER_KEYS entry %q: want version:secret", part)
+		}
+		if n >= ver {
+			return nil, fmt.Errorf("CLUSTER_KEYS version %d: retired keys must be below CLUSTER_KEY_VERSION %d", n, ver)
+		}
+		kr.add(n, []byte(secret), expires)
+	}
+	return kr, nil
+}
+
+// usesDemoKey reports whether any key in the ring is the built-in default.
+func (kr *keyring) usesDemoKey() bool {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, k := range kr.keys {
+		if string(k.key) == demoClusterKey {
+			return true
+		}
+	}
+	return false
+}
+
+// refuseDemoKey answers 403 while the node runs with the built-in key, which
+// anyone can use to sign node tokens. Such a node is standalone and has no
+// business accepting peers.
+func (s *Server) refuseDemoKey(w http.ResponseWriter) bool {
+	if !s.keys.usesDemoKey() {
+		return false
+	}
+	http.Error(w, "cluster disabled: CLUSTER_KEY not configured", http.StatusForbidden)
+	return true
+}
+
+// rotateKey serves POST /_cluster/keys/rotate?grace=24h for admins: a new
+// random key becomes active here and on every peer, and the old one keeps
+// verifying until the grace period ends. With peers it needs cluster mTLS,
+// the only channel the new key is shared over.
+func (s *Server) rotateKey(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !s.tls.mutual() && len(s.peerLinks()) > 0 {
+		http.Error(w, "key rotation reaches peers only over cluster mTLS (TLS_CLUSTER_CA)", http.StatusConflict)
+		return
+	}
+	grace := keyGrace
+	if v := r.URL.Query().Get("grace"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid grace", http.StatusBadRequest)
+			return
+		}
+		grace = d
+	}
+	ver, err := s.keys.rotate()
+	if err != nil {
+		http.Error(w, "key generation failed", http.StatusInternalServerError)
+		return
+	}
+	// peers learn the new key before anything is signed with it
+	s.broadcastKeys()
+	s.keys.activate(ver, grace)
+	s.broadcastKeys()
+	log.Printf("keyring: rotated to key version %d", ver)
+	s.listKeys(w, r)
+}
+
+// listKeys serves GET /_cluster/keys for admins.
+func (s *Server) listKeys(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"keys": s.keys.info()})
+}
+
+func (s *Server) keysFrame() clusterFrame {
+	b, _ := json.Marshal(s.keys.chain())
+	return clusterFrame{Type: "Keys", Data: b}
+}
+
+// broadcastKeys queues the key chain on every peer stream; sessions not
+// verified by the cluster CA discard it.
+func (s *Server) broadcastKeys() {
+	f := s.keysFrame()
+	for _, l := range s.peerLinks() {
+		l.enqueue(f)
+	}
+}
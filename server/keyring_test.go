@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyringFromEnvRetiresOlderKeys(t *testing.T) {
+	t.Setenv("CLUSTER_KEY", "k3")
+	t.Setenv("CLUSTER_KEY_VERSION", "3")
+	t.Setenv("CLUSTER_KEYS", "1:k1, 2:k2")
+	t.Setenv("CLUSTER_KEYS_GRACE", "1h")
+	kr, err := keyringFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, key := kr.signing(); v != 3 || string(key) != "k3" {
+		t.Fatalf("signing with version %d %q, want 3 k3", v, key)
+	}
+	for _, ki := range kr.info() {
+		switch {
+		case ki.Active && ki.Expires != nil:
+			t.Errorf("active version %d expires", ki.Version)
+		case !ki.Active && (ki.Expires == nil || time.Until(*ki.Expires) > time.Hour):
+			t.Errorf("retired version %d expires at %v, want within 1h", ki.Version, ki.Expires)
+		}
+	}
+	kr.setExpiry(1, time.Now().Add(-time.Second))
+	if kr.lookup(1) != nil {
+		t.Error("expired version 1 still verifies")
+	}
+	if string(kr.lookup(2)) != "k2" {
+		t.Error("version 2 no longer verifies within its grace")
+	}
+
+	for _, keys := range []string{"3:other", "4:newer", "x:k", "2:"} {
+		t.Setenv("CLUSTER_KEYS", keys)
+		if _, err := keyringFromEnv(); err == nil {
+			t.Errorf("CLUSTER_KEYS=%q accepted", keys)
+		}
+	}
+}
+
+func TestKeyChainMerge(t *testing.T) {
+	a := newKeyring(1, []byte("k1"))
+	v2, err := a.rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.activate(v2, time.Hour)
+	v3, _ := a.rotate()
+	a.activate(v3, time.Hour)
+	f := a.chain()
+	if f.Active != v3 || len(f.Chain) != 3 || f.Chain[0].Wrapped != nil {
+		t.Fatalf("chain = %+v, want versions 1..3 with the oldest unwrapped", f)
+	}
+
+	b := newKeyring(1, []byte("k1"))
+	b.merge(f)
+	if ver, key := b.signing(); ver != v3 || string(key) != string(a.lookup(v3)) {
+		t.Fatalf("merged ring signs with version %d, want %d with the same key", ver, v3)
+	}
+	for _, v := range []int{1, v2} {
+		if b.lookup(v) == nil {
+			t.Errorf("version %d lost in merge", v)
+		}
+	}
+	if got, want := b.info()[0].Expires, a.info()[0].Expires; got == nil || !got.Equal(*want) {
+		t.Errorf("version 1 expiry %v, want the sender's %v", got, want)
+	}
+
+	// a node holding none of the keys cannot unwrap any
+	c := newKeyring(1, []byte("other"))
+	c.merge(f)
+	if ver, _ := c.signing(); ver != 1 || c.lookupAny(v2) != nil {
+		t.Fatalf("unrelated ring adopted versions it cannot unwrap (signing %d)", ver)
+	}
+
+	// tampered and replayed-old chains change nothing
+	d := newKeyring(1, []byte("k1"))
+	bad := a.chain()
+	bad.Chain[1].Wrapped[len(bad.Chain[1].Wrapped)-1] ^= 1
+	d.merge(bad)
+	if d.lookupAny(v2) != nil {
+		t.Fatal("tampered key accepted")
+	}
+	b.merge(keysFrame{Active: 1, Chain: []chainedKey{{Version: 1}}})
+	if ver, _ := b.signing(); ver != v3 {
+		t.Fatalf("older Active rolled the ring back to %d", ver)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+var errTooManyChannels = &ingestError{http.StatusServiceUnavailable, "too many channels"}
+
+// dormantRing is the replay buffer of a reaped hub, handed to the next hub
+// created for the same channel.
+type dormantRing struct {
+	ring *replayRing
+	at   time.Time
+}
+
+// subscribe adds conn to channel's hub, retrying if the hub is reaped between
+// lookup and registration.
+func (s *Server) subscribe(channel string, conn *websocket.Conn, sub subscription) (*Hub, error) {
+	for {
+		h, err := s.hubFor(channel)
+		if err != nil {
+			return nil, err
+		}
+		if h.Add(conn, sub) {
+			return h, nil
+		}
+	}
+}
+
+// canHost reports errTooManyChannels if channel has no hub and no new one
+// may be created, without creating it.
+func (s *Server) canHost(channel string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.hubs[channel]; !ok && s.maxChannels > 0 && len(s.hubs) >= s.maxChannels {
+		return errTooManyChannels
+	}
+	return nil
+}
+
+// runHubReaper removes hubs that have had no subscribers and no messages for
+// s.hubIdle, keeping their replay buffers until the entries age out.
+func (s *Server) runHubReaper(ctx context.Context) {
+	if s.hubIdle <= 0 {
+		return
+	}
+	t := time.NewTicker(max(min(s.hubIdle/2, time.Minute), time.Second))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if n := s.reapHubs(time.Now()); n > 0 {
+			log.Printf("reaped %d idle channel hubs", n)
+		}
+	}
+}
+
+func (s *Server) reapHubs(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reaped := 0
+	for ch, h := range s.hubs {
+		if now.Sub(time.Unix(0, h.lastActive.Load())) < s.hubIdle || !h.close() {
+			continue
+		}
+		delete(s.hubs, ch)
+		delete(s.patterns, ch)
+		s.metrics.release(ch, h.stats)
+		if !h.replay.empty() {
+			s.dormant[ch] = dormantRing{ring: h.replay, at: now}
+		}
+		reaped++
+	}
+	for ch, d := range s.dormant {
+		if d.ring.empty() {
+			delete(s.dormant, ch)
+		}
+	}
+	// an unbounded replay age keeps rings forever; bound them like live hubs
+	for s.maxChannels > 0 && len(s.dormant) > s.maxChannels {
+		oldest := ""
+		for ch, d := range s.dormant {
+			if oldest == "" || d.at.Before(s.dormant[oldest].at) {
+				oldest = ch
+			}
+		}
+		delete(s.dormant, oldest)
+	}
+	return reaped
+}
+
+// close retires an idle hub with no subscribers; it reports false if
+// someone subscribed or a publisher is waiting for queue room in the
+// meantime. Its run goroutine drains and exits.
+func (h *Hub) close() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) > 0 || h.closed || h.waiting.Load() > 0 {
+		return false
+	}
+	h.closed = true
+	close(h.in)
+	return true
+}
+
+func (h *Hub) touch() {
+	h.lastActive.Store(time.Now().UnixNano())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func newLifecycleServer(maxChannels int) *Server {
+	return &Server{
+		hubs:        make(map[string]*Hub),
+		patterns:    make(map[string]*Hub),
+		dormant:     make(map[string]dormantRing),
+		keys:        newKeyring(1, []byte("k")),
+		metrics:     newMetrics(10),
+		replayMax:   10,
+		replayAge:   time.Hour,
+		hubIdle:     time.Minute,
+		maxChannels: maxChannels,
+	}
+}
+
+func TestReapHubs(t *testing.T) {
+	s := newLifecycleServer(3)
+	idle, _ := s.hubFor("/idle")
+	idle.replay.push([]byte(`{"_meta":{"id":"1"}}`))
+	subscribed, _ := s.hubFor("/subscribed")
+	conn := &websocket.Conn{}
+	if !subscribed.Add(conn, subscription{}) {
+		t.Fatal("Add to a live hub failed")
+	}
+	waiting, _ := s.hubFor("/waiting")
+	waiting.waiting.Add(1)
+
+	later := time.Now().Add(2 * time.Minute)
+	if n := s.reapHubs(time.Now()); n != 0 {
+		t.Fatalf("reaped %d hubs before they went idle", n)
+	}
+	if n := s.reapHubs(later); n != 1 {
+		t.Fatalf("reaped %d hubs, want only the idle one", n)
+	}
+	if _, ok := s.hubs["/idle"]; ok {
+		t.Fatal("idle hub kept")
+	}
+	if _, ok := s.hubs["/subscribed"]; !ok {
+		t.Fatal("hub with a subscriber reaped")
+	}
+	if _, ok := s.hubs["/waiting"]; !ok {
+		t.Fatal("hub with a waiting publisher reaped")
+	}
+	if idle.Broadcast(context.Background(), []byte(`{}`)) || idle.Add(&websocket.Conn{}, subscription{}) {
+		t.Fatal("reaped hub accepted a message or subscriber")
+	}
+
+	// the next hub for the channel picks up its replay buffer
+	revived, _ := s.hubFor("/idle")
+	if revived == idle {
+		t.Fatal("reaped hub reused")
+	}
+	if got := revived.replay.snapshot(replayQuery{last: -1}); len(got) != 1 {
+		t.Fatalf("revived hub replays %d messages, want 1", len(got))
+	}
+	if _, ok := s.dormant["/idle"]; ok {
+		t.Fatal("revived ring still dormant")
+	}
+
+	subscribed.Remove(conn)
+	waiting.waiting.Add(-1)
+	if n := s.reapHubs(later.Add(time.Minute)); n != 3 {
+		t.Fatalf("reaped %d hubs once released, want 3", n)
+	}
+	if _, ok := s.dormant["/idle"]; len(s.dormant) != 1 || !ok {
+		t.Fatalf("dormant = %v, want only the non-empty /idle buffer", s.dormant)
+	}
+}
+
+func TestSubscribeRetriesReapedHub(t *testing.T) {
+	s := newLifecycleServer(0)
+	old, _ := s.hubFor("/c")
+	s.reapHubs(time.Now().Add(time.Hour))
+	conn := &websocket.Conn{}
+	h, err := s.subscribe("/c", conn, subscription{})
+	if err != nil || h == old {
+		t.Fatalf("subscribe = %p, %v; want a fresh hub", h, err)
+	}
+	h.Remove(conn)
+}
+
+func TestMaxChannels(t *testing.T) {
+	s := newLifecycleServer(2)
+	for _, ch := range []string{"/a", "/b"} {
+		if _, err := s.hubFor(ch); err != nil {
+			t.Fatalf("hubFor(%s): %v", ch, err)
+		}
+	}
+	if _, err := s.hubFor("/c"); err != errTooManyChannels {
+		t.Fatalf("hubFor over the cap = %v, want errTooManyChannels", err)
+	}
+	if err := s.canHost("/c"); err != errTooManyChannels {
+		t.Fatalf("canHost over the cap = %v", err)
+	}
+	if err := s.canHost("/a"); err != nil {
+		t.Fatalf("canHost(existing) = %v", err)
+	}
+	if errorStatus(errTooManyChannels) != 503 {
+		t.Fatalf("too many channels maps to %d, want 503", errorStatus(errTooManyChannels))
+	}
+	s.reapHubs(time.Now().Add(time.Hour))
+	if _, err := s.hubFor("/c"); err != nil {
+		t.Fatalf("hubFor after reaping: %v", err)
+	}
+}
+
+func TestDormantRingsBounded(t *testing.T) {
+	s := newLifecycleServer(2)
+	now := time.Now().Add(time.Hour)
+	for i, ch := range []string{"/d1", "/d2", "/d3"} {
+		h, _ := s.hubFor(ch)
+		h.replay.push([]byte(`{"_meta":{"id":"x"}}`))
+		s.reapHubs(now.Add(time.Duration(i) * time.Minute))
+	}
+	if len(s.dormant) != 2 {
+		t.Fatalf("%d dormant rings, want MAX_CHANNELS=2", len(s.dormant))
+	}
+	if _, ok := s.dormant["/d1"]; ok {
+		t.Fatal("oldest dormant ring kept over newer ones")
+	}
+	// rings whose entries aged out are dropped
+	d2 := s.dormant["/d2"].ring
+	d2.buf[d2.start].at = time.Now().Add(-2 * time.Hour)
+	s.reapHubs(now)
+	if _, ok := s.dormant["/d2"]; ok {
+		t.Fatal("expired dormant ring kept")
+	}
+}
@@ -10,8 +10,12 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -23,115 +27,497 @@ import (
 type Hub struct {
 	mu      sync.RWMutex
 	clients map[*websocket.Conn]*client
-	in      chan []byte
+	in      chan hubMsg
+	replay  *replayRing
+	stats   *hubStats
+	policy  backpressure
+	// gap renders the notice that tells a client how many messages it missed
+	gap     func(skipped int64) []byte
+	pending atomic.Int64 // messages dropped from in since the last one queued
+	// lastActive is the unixNs of the last message or subscriber change
+	lastActive atomic.Int64
+	// waiting counts publishers blocked in wait; a hub with any is not reaped
+	waiting atomic.Int64
+	closed  bool // reaped; guarded by mu
+	// seeded holds the ids a pattern hub was seeded with until seededUntil;
+	// set under mu before run sees a message, then owned by run
+	seeded      map[string]bool
+	seededUntil time.Time
 }
 
-func NewHub() *Hub {
-	return &Hub{clients: make(map[*websocket.Conn]*client), in: make(chan []byte, 1024)}
+// hubMsg is a queued broadcast; ephemeral messages are not kept for replay.
+// skipped counts the messages dropped from the hub queue just before it.
+type hubMsg struct {
+	data      []byte
+	ephemeral bool
+	skipped   int64
+	// reached, if set, marks a point in the queue: run closes it and
+	// delivers nothing
+	reached chan struct{}
+}
+
+// outMsg is a message queued for one client, with the number it missed before it.
+type outMsg struct {
+	data    []byte
+	skipped int64
+}
+
+func NewHub(replayMax int, replayAge time.Duration) *Hub {
+	h := &Hub{
+		clients: make(map[*websocket.Conn]*client),
+		in:      make(chan hubMsg, 1024),
+		replay:  newReplayRing(replayMax, replayAge),
+		stats:   &hubStats{},
+		policy:  backpressure{mode: dropNewest},
+		gap:     plainGapNotice,
+	}
+	h.touch()
+	return h
 }
 
 type client struct {
-	conn *websocket.Conn
-	send chan []byte
+	conn    *websocket.Conn
+	send    chan outMsg
+	done    chan struct{} // closed by Remove; send is never closed
+	backlog [][]byte
+	filter  *subFilter
+	wrap    func([]byte) []byte
+	// owned by Hub.run
+	pending int64 // messages dropped for this client since the last one queued
+	drops   int64
+	closing bool
 }
 
-func (h *Hub) Add(conn *websocket.Conn) {
+// subscription describes how a connection follows a hub.
+type subscription struct {
+	replay replayQuery
+	filter *subFilter
+	// wrap, if set, frames each outgoing message (used by the multiplexed socket)
+	wrap func([]byte) []byte
+}
+
+// Add registers conn and queues the replay selected by sub ahead of live messages.
+// A non-nil sub.filter is applied to both the replay and live messages.
+// It reports false if the hub has been reaped.
+func (h *Hub) Add(conn *websocket.Conn, sub subscription) bool {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	c := &client{conn: conn, send: make(chan []byte, 256)}
+	if h.closed {
+		return false
+	}
+	h.touch()
+	// snapshot under the hub lock so run cannot fan out a message that is also in the backlog
+	backlog := h.replay.snapshot(sub.replay)
+	if f := sub.filter; f != nil {
+		kept := backlog[:0]
+		for _, msg := range backlog {
+			if out, ok := f.apply(decodeObject(msg), msg); ok {
+				kept = append(kept, out)
+			}
+		}
+		backlog = kept
+	}
+	c := &client{conn: conn, send: make(chan outMsg, 256), done: make(chan struct{}), backlog: backlog, filter: sub.filter, wrap: sub.wrap}
 	h.clients[conn] = c
+	h.stats.subscribers.Add(1)
 	go h.writePump(c)
+	return true
 }
 
 func (h *Hub) Remove(conn *websocket.Conn) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	if c, ok := h.clients[conn]; ok {
+		h.touch()
 		delete(h.clients, conn)
-		close(c.send)
+		h.stats.subscribers.Add(-1)
+		close(c.done)
 	}
 }
 
-func (h *Hub) Broadcast(_ context.Context, msg []byte) {
-	// enqueue into hub queue; drop if full to preserve latency
-	select {
-	case h.in <- msg:
-	default:
+// Broadcast queues msg for the hub's subscribers and replay. It reports false
+// if the hub has been reaped.
+func (h *Hub) Broadcast(_ context.Context, msg []byte) bool {
+	return h.enqueue(hubMsg{data: msg})
+}
+
+// Notice broadcasts a system message that is not kept for replay.
+func (h *Hub) Notice(_ context.Context, msg []byte) bool {
+	return h.enqueue(hubMsg{data: msg, ephemeral: true})
+}
+
+func (h *Hub) enqueue(m hubMsg) bool {
+	// the read lock, or a count in h.waiting, keeps a reaper from closing h.in under us
+	h.mu.RLock()
+	if h.closed {
+		h.mu.RUnlock()
+		return false
+	}
+	h.touch()
+	// enqueue into hub queue; when full the channel's backpressure policy decides
+	m.skipped = h.pending.Swap(0)
+	queued := h.offer(&m)
+	blocking := !queued && h.policy.mode == block
+	if blocking {
+		h.waiting.Add(1)
+	}
+	h.mu.RUnlock()
+	if blocking {
+		queued = h.wait(&m)
+		h.waiting.Add(-1)
+	}
+	if !queued {
+		h.pending.Add(m.skipped + 1)
+		h.stats.hubDrops.Add(1)
 	}
+	return true
 }
 
 func (h *Hub) writePump(c *client) {
-	for msg := range c.send {
+	write := func(msg []byte) {
+		if c.wrap != nil {
+			msg = c.wrap(msg)
+		}
 		// decouple from request context, with short timeout to avoid head-of-line blocking
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		_ = c.conn.Write(ctx, websocket.MessageText, msg)
+		if err := c.conn.Write(ctx, websocket.MessageText, msg); err != nil {
+			if ctx.Err() != nil {
+				h.stats.writeTimeouts.Add(1)
+			} else {
+				h.stats.writeErrors.Add(1)
+			}
+		}
 		cancel()
 	}
+	for _, msg := range c.backlog {
+		write(msg)
+	}
+	c.backlog = nil
+	for {
+		select {
+		case m := <-c.send:
+			if m.skipped > 0 {
+				write(h.gap(m.skipped))
+			}
+			if m.data != nil {
+				write(m.data)
+			}
+		case <-c.done:
+			return
+		}
+	}
 }
 
 func (h *Hub) run() {
-	for msg := range h.in {
-		h.mu.RLock()
-		for _, c := range h.clients {
-			select {
-			case c.send <- msg:
-			default:
-				// drop per slow client to keep overall latency low
+	flush := time.NewTicker(gapFlushInterval)
+	defer flush.Stop()
+	for {
+		select {
+		case m, ok := <-h.in:
+			if !ok {
+				return
 			}
+			h.fanout(m)
+		case <-flush.C:
+			h.flushGaps()
 		}
+	}
+}
+
+func (h *Hub) fanout(m hubMsg) {
+	// push and snapshot under one lock so Add's backlog and the live stream
+	// neither overlap nor miss a message; deliver may wait under a block
+	// policy, so it runs unlocked and Add and Remove are never held up
+	if m.reached != nil {
+		close(m.reached)
+		return
+	}
+	h.mu.RLock()
+	if h.seeded != nil && !m.ephemeral && h.dropSeeded(m.data) {
 		h.mu.RUnlock()
+		return
+	}
+	if !m.ephemeral {
+		h.replay.push(m.data)
+	}
+	clients := make([]*client, 0, len(h.clients))
+	for _, c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.RUnlock()
+	var doc map[string]any
+	decoded := false
+	for _, c := range clients {
+		out := m.data
+		if c.filter != nil {
+			if !decoded {
+				doc, decoded = decodeObject(m.data), true
+			}
+			var ok bool
+			if out, ok = c.filter.apply(doc, m.data); !ok {
+				// the hub-queue drops m reports may be what the filter wanted
+				c.pending += m.skipped
+				continue
+			}
+		}
+		om := outMsg{data: out, skipped: m.skipped + c.pending}
+		if h.deliver(c, om) {
+			c.pending = 0
+			h.stats.fanout.Add(1)
+			continue
+		}
+		// drop per slow client to keep overall latency low
+		c.pending = om.skipped + 1
+		c.drops++
+		h.stats.clientDrops.Add(1)
+		if h.policy.mode == disconnect && c.drops >= h.policy.limit && !c.closing {
+			c.closing = true
+			go c.conn.Close(websocket.StatusPolicyViolation, "slow consumer")
+		}
+	}
+}
+
+// flushGaps sends a bare gap notice to clients whose drops no later message
+// has reported yet, e.g. after a burst at the end of a stream.
+func (h *Hub) flushGaps() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	hubSkipped := h.pending.Swap(0)
+	for _, c := range h.clients {
+		c.pending += hubSkipped
+		if c.pending == 0 {
+			continue
+		}
+		select {
+		case c.send <- outMsg{skipped: c.pending}:
+			c.pending = 0
+		default:
+		}
 	}
 }
 
 type Server struct {
-	hubs   map[string]*Hub
-	mu     sync.RWMutex
-	key    []byte
-	nodeID string
-	keyVer int
-	peers  []string
-	httpc  *http.Client
+	hubs      map[string]*Hub
+	patterns  map[string]*Hub // subset of hubs whose key is a wildcard pattern
+	mu        sync.RWMutex
+	keys      *keyring
+	nodeID    string
+	peers     []string
+	httpc     *http.Client
+	replayMax int
+	replayAge time.Duration
+	store     *Store
+	dedup     *dedupCache
+	// envelopeWindow bounds how far a received envelope's _meta.ts may be from now
+	envelopeWindow time.Duration
+	// encryptPeers seals envelopes forwarded to peers and refuses plaintext ones
+	encryptPeers bool
+	// acceptJoin lets new nodes join through POST /_cluster/join
+	acceptJoin bool
+	publicURL  string
+	admin      string
+	auth       atomic.Pointer[authConfig] // nil leaves every channel open
+	limits     atomic.Pointer[limits]
+	config     *configSource // nil without a config file
+	tls        *tlsSetup     // nil serves plain HTTP
+	metrics    *metrics
+	policies   []channelPolicy
+	// hubIdle is how long a hub without subscribers or messages lives on
+	hubIdle     time.Duration
+	maxChannels int
+	dormant     map[string]dormantRing // replay buffers of reaped hubs
+
+	clusterMu  sync.Mutex
+	clusterCtx context.Context
+	links      map[string]*peerLink // by peer address
+	members    map[string]*member   // by peer address
+	selfAddrs  map[string]bool      // addresses found to reach this node
+	joinTokens map[string]time.Time // one-time join token → expiry
+
+	suspectAfter time.Duration
+	deadAfter    time.Duration
+	removeAfter  time.Duration
 }
 
 func NewServer() *Server {
-	key := []byte(os.Getenv("CLUSTER_KEY"))
-	if len(key) == 0 {
-		key = []byte("dev-demo-key-please-change")
+	keys, err := keyringFromEnv()
+	if err != nil {
+		log.Fatal("cluster keys: ", err)
+	}
+	auth, err := authFromEnv()
+	if err != nil {
+		log.Fatal("auth: ", err)
+	}
+	lim, err := limitsFromEnv()
+	if err != nil {
+		log.Fatal("limits: ", err)
+	}
+	policies, err := policiesFromEnv()
+	if err != nil {
+		log.Fatal("backpressure: ", err)
 	}
 	node := os.Getenv("NODE_ID")
 	if node == "" {
 		node = "node-local"
 	}
+	replayMax := 200
+	if v, err := strconv.Atoi(os.Getenv("REPLAY_MAX")); err == nil && v >= 0 {
+		replayMax = v
+	}
+	replayAge := durationEnv("REPLAY_MAX_AGE", 10*time.Minute)
+	dedupCapacity := 100000
+	if v, err := strconv.Atoi(os.Getenv("DEDUP_CAPACITY")); err == nil && v >= 0 {
+		dedupCapacity = v
+	}
+	tlsSetup, err := tlsFromEnv(os.Getenv("PUBLIC_URL"))
+	if err != nil {
+		log.Fatal("tls: ", err)
+	}
+	maxChannels := 10000
+	if v, err := strconv.Atoi(os.Getenv("MAX_CHANNELS")); err == nil && v >= 0 {
+		maxChannels = v
+	}
+	s := &Server{
+		hubs:           make(map[string]*Hub),
+		patterns:       make(map[string]*Hub),
+		keys:           keys,
+		nodeID:         node,
+		peers:          peersFromEnv(),
+		httpc:          &http.Client{Timeout: 2 * time.Second, Transport: tlsSetup.peerTransport()},
+		tls:            tlsSetup,
+		replayMax:      replayMax,
+		replayAge:      replayAge,
+		envelopeWindow: durationEnv("ENVELOPE_WINDOW", 5*time.Minute),
+		dedup:          newDedupCache(dedupCapacity, durationEnv("DEDUP_TTL", 10*time.Minute)),
+		encryptPeers:   boolEnv("PEER_ENCRYPTION"),
+		acceptJoin:     os.Getenv("CLUSTER_ACCEPT_JOIN") != "false",
+		publicURL:      normalizeAddress(os.Getenv("PUBLIC_URL")),
+		admin:          os.Getenv("ADMIN_TOKEN"),
+		metrics:        metricsFromEnv(),
+		policies:       policies,
+		hubIdle:        durationEnv("HUB_IDLE_TIMEOUT", 10*time.Minute),
+		maxChannels:    maxChannels,
+		dormant:        make(map[string]dormantRing),
+		links:          make(map[string]*peerLink),
+		members:        make(map[string]*member),
+		selfAddrs:      make(map[string]bool),
+		joinTokens:     make(map[string]time.Time),
+
+		suspectAfter: durationEnv("MEMBER_SUSPECT_AFTER", 45*time.Second),
+		deadAfter:    durationEnv("MEMBER_DEAD_AFTER", 2*time.Minute),
+		removeAfter:  durationEnv("MEMBER_REMOVE_AFTER", 24*time.Hour),
+	}
+	s.auth.Store(auth)
+	s.limits.Store(lim)
+	return s
+}
+
+// peersFromEnv reads the comma-separated static peer addresses in PEERS.
+func peersFromEnv() []string {
 	var peers []string
-	if v := os.Getenv("PEERS"); v != "" {
-		parts := strings.Split(v, ",")
-		for _, p := range parts {
-			p = strings.TrimSpace(p)
-			if p != "" {
-				peers = append(peers, p)
-			}
+	for _, p := range strings.Split(os.Getenv("PEERS"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			peers = append(peers, p)
 		}
 	}
-	return &Server{
-		hubs:   make(map[string]*Hub),
-		key:    key,
-		nodeID: node,
-		keyVer: 1,
-		peers:  peers,
-		httpc:  &http.Client{Timeout: 2 * time.Second},
+	return peers
+}
+
+// durationEnv reads a non-negative duration from key, falling back to def.
+func durationEnv(key string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil && v >= 0 {
+		return v
 	}
+	return def
+}
+
+func boolEnv(key string) bool {
+	v := os.Getenv(key)
+	return v == "1" || v == "true"
 }
 
-func (s *Server) hubFor(channel string) *Hub {
+// hubFor returns the live hub for channel, creating it unless s.maxChannels
+// hubs already exist. A reaped channel gets its replay buffer back.
+func (s *Server) hubFor(channel string) (*Hub, error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	h, ok := s.hubs[channel]
+	var seed []*replayRing
+	var live []*Hub
+	seeding := false
 	if !ok {
-		h = NewHub()
+		if s.maxChannels > 0 && len(s.hubs) >= s.maxChannels {
+			s.mu.Unlock()
+			return nil, errTooManyChannels
+		}
+		h = NewHub(s.replayMax, s.replayAge)
+		d, revived := s.dormant[channel]
+		if revived {
+			h.replay = d.ring
+			delete(s.dormant, channel)
+		}
+		h.stats = s.metrics.channel(channel)
+		h.policy = s.policyFor(channel)
+		h.gap = func(skipped int64) []byte {
+			raw, _ := json.Marshal(gapNotice(skipped))
+			if env, err := s.injectMeta(channel, raw); err == nil {
+				return env
+			}
+			return raw
+		}
+		if isPattern(channel) {
+			// seed after releasing s.mu; holding h.mu keeps subscribers and
+			// fanout off the replay until it is filled
+			seed, live = s.patternSources(channel)
+			seeding = true
+			h.mu.Lock()
+			s.patterns[channel] = h
+		}
 		go h.run()
 		s.hubs[channel] = h
 	}
-	return h
+	s.mu.Unlock()
+	if seeding {
+		seedPattern(h, seed, live)
+		h.mu.Unlock()
+	}
+	return h, nil
+}
+
+// publish delivers an envelope to the channel's subscribers and to every
+// matching pattern subscription, and appends it to the store.
+func (s *Server) publish(ctx context.Context, channel string, env []byte) error {
+	for {
+		h, err := s.hubFor(channel)
+		if err != nil {
+			return err
+		}
+		if h.Broadcast(ctx, env) {
+			h.stats.in.Add(1)
+			break
+		}
+	}
+	// broadcast outside s.mu: a block policy may wait for queue room
+	var matched []*Hub
+	s.mu.RLock()
+	for p, h := range s.patterns {
+		if matchChannel(p, channel) {
+			matched = append(matched, h)
+		}
+	}
+	s.mu.RUnlock()
+	for _, h := range matched {
+		h.Broadcast(ctx, env)
+	}
+	if s.store != nil {
+		var ns int64
+		if m, ok := parseMeta(env); ok {
+			ns = m.UnixNs
+		}
+		if err := s.store.Append(channel, env, ns); err != nil {
+			log.Println("store append:", err)
+		}
+	}
+	return nil
 }
 
 func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
@@ -139,8 +525,10 @@ func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte(`{"ok":true}`))
 }
 
-// anyChannel handles any unmatched path as a channel path.
-// GET → WebSocket; POST → JSON broadcast.
+// anyChannel handles any unmatched path as a channel path. Subscriptions may use
+// "*" (one segment) and "**" (any depth) path segments, e.g. /logs/**.
+// GET → WebSocket (replaying recent history per ?since=/?last=; text frames sent
+// by the client are published like a POST); POST → JSON broadcast.
 func (s *Server) anyChannel(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	if path == "/" || path == "" || path == "/healthz" {
@@ -150,13 +538,31 @@ func (s *Server) anyChannel(w http.ResponseWriter, r *http.Request) {
 	channel := "/" + strings.TrimPrefix(path, "/")
 	switch r.Method {
 	case http.MethodGet:
+		p := s.authorize(w, r, permSubscribe, channel)
+		if p == nil {
+			return
+		}
+		q := r.URL.Query()
+		filter, err := parseSubFilter(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// check the cap without creating a hub: plain GETs that never upgrade must not use it up
+		if err := s.canHost(channel); err != nil {
+			writeIngestError(w, err)
+			return
+		}
 		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: []string{"*"}})
 		if err != nil {
 			log.Println("ws accept:", err)
 			return
 		}
-		hub := s.hubFor(channel)
-		hub.Add(c)
+		hub, err := s.subscribe(channel, c, subscription{replay: parseReplayQuery(q.Get("since"), q.Get("last")), filter: filter})
+		if err != nil {
+			_ = c.Close(websocket.StatusTryAgainLater, err.Error())
+			return
+		}
 		// broadcast a welcome/system message
 		{
 			sys := map[string]any{
@@ -168,7 +574,7 @@ func (s *Server) anyChannel(w http.ResponseWriter, r *http.Request) {
 			}
 			if raw, err := json.Marshal(sys); err == nil {
 				if env, err := s.injectMeta(channel, raw); err == nil {
-					hub.Broadcast(r.Context(), env)
+					hub.Notice(r.Context(), env)
 				}
 			}
 		}
@@ -176,32 +582,55 @@ func (s *Server) anyChannel(w http.ResponseWriter, r *http.Request) {
 			hub.Remove(c)
 			_ = c.Close(websocket.StatusNormalClosure, "bye")
 		}()
+		// text frames from the subscriber are published to the channel; ?ack=1 replies to each
+		ack := q.Get("ack") == "1" || q.Get("ack") == "true"
+		ip := clientIP(r)
+		c.SetReadLimit(maxBodyBytes)
 		for {
-			if _, _, err := c.Read(r.Context()); err != nil {
+			typ, data, err := c.Read(r.Context())
+			if err != nil {
 				return
 			}
+			if typ != websocket.MessageText || len(bytes.TrimSpace(data)) == 0 {
+				continue
+			}
+			var env []byte
+			if !p.can(permPublish, channel) {
+				err = &ingestError{http.StatusForbidden, "publish not allowed"}
+			} else if err = s.admit(p, ip, channel, len(data)); err == nil {
+				env, err = s.ingest(r.Context(), channel, data, false)
+			}
+			if ack {
+				writeMuxReply(c, publishReply("", channel, env, err))
+			}
 		}
 	case http.MethodPost:
-		var raw json.RawMessage
-		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&raw); err != nil {
-			http.Error(w, "invalid json", http.StatusBadRequest)
+		p := s.authorize(w, r, permPublish, channel)
+		if p == nil {
 			return
 		}
-		var tmp map[string]json.RawMessage
-		_ = json.Unmarshal(raw, &tmp)
-		envelope := raw
-		if _, ok := tmp["_meta"]; !ok {
-			var err error
-			envelope, err = s.injectMeta(channel, raw)
-			if err != nil {
-				http.Error(w, "envelope error", http.StatusInternalServerError)
-				return
-			}
+		if isNDJSON(r) {
+			s.ingestBatch(w, r, p, channel)
+			return
+		}
+		raw, err := readPublishBody(w, r)
+		if err != nil {
+			writeIngestError(w, err)
+			return
+		}
+		if err := s.admit(p, clientIP(r), channel, len(raw)); err != nil {
+			writeIngestError(w, err)
+			return
+		}
+		_, err = s.ingest(r.Context(), channel, raw, false)
+		if err == errDuplicate {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"ok":true,"duplicate":true}`))
+			return
 		}
-		hub := s.hubFor(channel)
-		hub.Broadcast(r.Context(), envelope)
-		if r.Header.Get("X-LogHUD-Origin") == "" {
-			go s.forwardToPeers(channel, envelope)
+		if err != nil {
+			writeIngestError(w, err)
+			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusAccepted)
@@ -211,6 +640,75 @@ func (s *Server) anyChannel(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// maxBodyBytes bounds a single published message.
+const maxBodyBytes = 1 << 20
+
+// ingestError is a rejected publish and the HTTP status it maps to.
+type ingestError struct {
+	status int
+	msg    string
+}
+
+func (e *ingestError) Error() string { return e.msg }
+
+func writeIngestError(w http.ResponseWriter, err error) {
+	if le, ok := err.(*limitError); ok {
+		w.Header().Set("Retry-After", le.retryAfter())
+		http.Error(w, le.msg, http.StatusTooManyRequests)
+		return
+	}
+	if ie, ok := err.(*ingestError); ok {
+		http.Error(w, ie.msg, ie.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// ingest envelopes raw, or verifies it if it already carries _meta, publishes it locally and
+// forwards it to peers unless it came from one. It returns the published envelope,
+// or errDuplicate with the envelope when its _meta.id was seen recently.
+func (s *Server) ingest(ctx context.Context, channel string, raw json.RawMessage, fromPeer bool) ([]byte, error) {
+	if isPattern(channel) {
+		return nil, &ingestError{http.StatusBadRequest, "cannot publish to a channel pattern"}
+	}
+	if len(raw) > maxBodyBytes {
+		return nil, &ingestError{http.StatusRequestEntityTooLarge, "message too large"}
+	}
+	if !json.Valid(raw) {
+		return nil, &ingestError{http.StatusBadRequest, "invalid json"}
+	}
+	raw = wrapMessage(raw)
+	var tmp map[string]json.RawMessage
+	_ = json.Unmarshal(raw, &tmp)
+	envelope := []byte(raw)
+	if _, ok := tmp["_meta"]; ok {
+		if err := s.verifyEnvelope(channel, raw); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		envelope, err = s.injectMeta(channel, raw)
+		if err != nil {
+			return nil, &ingestError{http.StatusInternalServerError, "envelope error"}
+		}
+	}
+	m, _ := parseMeta(envelope)
+	// refuse a channel over the cap before its id is recorded as seen
+	if _, err := s.hubFor(channel); err != nil {
+		return nil, err
+	}
+	if s.dedup.seen(m.ID, fromPeer) {
+		return envelope, errDuplicate
+	}
+	if err := s.publish(ctx, channel, envelope); err != nil {
+		return nil, err
+	}
+	if !fromPeer {
+		s.forwardToPeers(channel, envelope)
+	}
+	return envelope, nil
+}
+
 func (s *Server) injectMeta(channel string, raw json.RawMessage) ([]byte, error) {
 	// parse to map
 	var payload map[string]any
@@ -220,13 +718,14 @@ func (s *Server) injectMeta(channel string, raw json.RawMessage) ([]byte, error)
 	// meta
 	now := time.Now().UTC()
 	id := uuid.Must(uuid.NewV7()).String()
+	ver, key := s.keys.signing()
 	meta := map[string]any{
 		"id":           id,
 		"ts":           now.Format(time.RFC3339Nano),
 		"unixNs":       now.UnixNano(),
 		"originNodeId": s.nodeID,
 		"channel":      channel,
-		"keyVersion":   s.keyVer,
+		"keyVersion":   ver,
 	}
 	// build temp without hmac
 	payload["_meta"] = meta
@@ -234,7 +733,7 @@ func (s *Server) injectMeta(channel string, raw json.RawMessage) ([]byte, error)
 	if err != nil {
 		return nil, err
 	}
-	h := hmac.New(sha256.New, s.key)
+	h := hmac.New(sha256.New, key)
 	h.Write(tmp)
 	mac := base64.StdEncoding.EncodeToString(h.Sum(nil))
 	meta["hmac"] = mac
@@ -242,40 +741,108 @@ func (s *Server) injectMeta(channel string, raw json.RawMessage) ([]byte, error)
 	return json.Marshal(payload)
 }
 
-func (s *Server) forwardToPeers(channel string, envelope []byte) {
-	if len(s.peers) == 0 {
-		return
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	// base outlives the signal so peer forwards can drain before it is cancelled
+	base, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal("config: ", err)
 	}
-	for _, base := range s.peers {
-		url := strings.TrimRight(base, "/") + channel
-		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(envelope))
+	s := NewServer()
+	s.config = cfg
+	if cfg != nil {
+		log.Printf("loaded config from %s", cfg.path)
+	}
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			s.reloadConfig()
+		}
+	}()
+	if dir := os.Getenv("STORE_DIR"); dir != "" {
+		st, err := storeFromEnv(dir)
 		if err != nil {
-			continue
+			log.Fatal("store: ", err)
 		}
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("X-LogHUD-Origin", s.nodeID)
-		resp, err := s.httpc.Do(req)
-		if err == nil && resp != nil {
-			_ = resp.Body.Close()
+		s.store = st
+		go st.Run(base, time.Minute)
+		log.Printf("storing channel logs in %s", dir)
+	}
+	var seed []member
+	if u := os.Getenv("JOIN_URL"); u != "" {
+		if seed, err = s.joinCluster(ctx, u, os.Getenv("JOIN_TOKEN")); err != nil {
+			log.Fatal("cluster join: ", err)
 		}
 	}
-}
-
-func main() {
-	s := NewServer()
+	clustered := len(s.peers) > 0 || s.publicURL != "" || os.Getenv("JOIN_URL") != ""
+	if clustered && s.keys.usesDemoKey() {
+		log.Fatal("cluster mode needs CLUSTER_KEY: refusing to run with the built-in demo key")
+	}
+	s.startCluster(base, seed)
+	go s.runHubReaper(base)
 	r := chi.NewRouter()
 	r.Use(middleware.RealIP)
+	r.Use(redactToken)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 
 	r.Get("/healthz", s.healthz)
+	r.Get("/_metrics", s.metricsHandler)
+	r.Get("/_history/*", s.history)
+	r.Get("/_ws", s.muxSocket)
+	r.Post("/_auth/tokens", s.mintAuthToken)
+	r.Group(func(r chi.Router) {
+		r.Use(s.requireClusterCert)
+		r.Get("/_cluster/stream", s.clusterStream)
+		r.Get("/_cluster/stats", s.clusterStats)
+		r.Post("/_cluster/join", s.clusterJoin)
+		r.Post("/_cluster/join-tokens", s.mintJoinToken)
+		r.Get("/_cluster/members", s.clusterMembers)
+		r.Delete("/_cluster/members/{nodeId}", s.removeMember)
+		r.Get("/_cluster/healthz", s.clusterHealthz)
+		r.Get("/_cluster/keys", s.listKeys)
+		r.Post("/_cluster/keys/rotate", s.rotateKey)
+	})
 	// fallback handler for any path (channels with slashes)
 	r.NotFound(s.anyChannel)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	addr := os.Getenv("LISTEN_ADDR")
+	if addr == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "8080"
+		}
+		addr = ":" + port
+	}
+	srv := &http.Server{Addr: addr, Handler: r}
+	if s.tls != nil {
+		srv.TLSConfig = s.tls.serverConfig()
+		go s.tls.certs.watch(base)
+		if boolEnv("TLS_SELF_SIGNED") {
+			log.Println("tls: serving a self-signed development certificate")
+		}
 	}
-	log.Printf("server listening on :%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	go func() {
+		log.Printf("server listening on %s", addr)
+		var err error
+		if s.tls != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+	stop()
+	timeout := durationEnv("SHUTDOWN_TIMEOUT", 15*time.Second)
+	log.Printf("shutting down, draining for up to %s", timeout)
+	sctx, scancel := context.WithTimeout(context.Background(), timeout)
+	defer scancel()
+	s.shutdown(sctx, srv)
 }
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// member states. Only "left" is gossiped; the others are this node's own view
+// derived from when it last heard from the peer.
+const (
+	stateAlive   = "alive"
+	stateSuspect = "suspect"
+	stateDead    = "dead"
+	stateLeft    = "left"
+)
+
+const (
+	gossipInterval = 5 * time.Second
+	gossipFanout   = 3
+)
+
+// member is a cluster node as exchanged in Members frames and join responses.
+// Updated versions join/leave events so gossip converges on the newest one.
+type member struct {
+	NodeID    string    `json:"nodeId"`
+	Address   string    `json:"address"`
+	PublicKey string    `json:"publicKey,omitempty"`
+	LastSeen  time.Time `json:"lastSeen,omitempty"`
+	State     string    `json:"state,omitempty"`
+	Updated   int64     `json:"updated,omitempty"` // unixNs of the last join/leave
+}
+
+func normalizeAddress(addr string) string {
+	return strings.TrimRight(strings.TrimSpace(addr), "/")
+}
+
+// stateOf derives m's state from its last heartbeat. Caller holds s.clusterMu.
+func (s *Server) stateOf(m *member, now time.Time) string {
+	if m.State == stateLeft {
+		return stateLeft
+	}
+	switch idle := now.Sub(m.LastSeen); {
+	case idle > s.deadAfter:
+		return stateDead
+	case idle > s.suspectAfter:
+		return stateSuspect
+	}
+	return stateAlive
+}
+
+// ensureLink starts a stream to addr unless one exists or addr is this node.
+// Caller holds s.clusterMu.
+func (s *Server) ensureLink(addr string) {
+	if addr == "" || addr == s.publicURL || s.selfAddrs[addr] {
+		return
+	}
+	if _, ok := s.links[addr]; ok {
+		return
+	}
+	l := newPeerLink(s, addr)
+	ctx, cancel := context.WithCancel(s.clusterCtx)
+	l.cancel = cancel
+	s.links[addr] = l
+	go l.run(ctx)
+}
+
+// dropLink stops the stream to addr. Caller holds s.clusterMu.
+func (s *Server) dropLink(addr string) {
+	if l, ok := s.links[addr]; ok {
+		l.cancel()
+		delete(s.links, addr)
+	}
+}
+
+// learnMembers merges ms into the member table, opening streams to new nodes
+// and closing those to nodes that left, and tells every peer when something changed.
+func (s *Server) learnMembers(ms []member) {
+	changed := false
+	now := time.Now()
+	s.clusterMu.Lock()
+	for _, m := range ms {
+		m.Address = normalizeAddress(m.Address)
+		if m.Address == "" || m.Address == s.publicURL || m.NodeID == s.nodeID || s.selfAddrs[m.Address] {
+			continue
+		}
+		cur, ok := s.members[m.Address]
+		if !ok {
+			if m.State == stateLeft {
+				continue
+			}
+			// a new member gets a full grace period before it can turn suspect
+			cur = &member{Address: m.Address, LastSeen: now, Updated: m.Updated}
+			s.members[m.Address] = cur
+			changed = true
+		}
+		if m.NodeID != "" && cur.NodeID != m.NodeID {
+			cur.NodeID, changed = m.NodeID, true
+		}
+		if m.PublicKey != "" {
+			cur.PublicKey = m.PublicKey
+		}
+		if m.Updated > cur.Updated {
+			cur.Updated = m.Updated
+			left := m.State == stateLeft
+			if left != (cur.State == stateLeft) {
+				cur.State, changed = "", true
+				if left {
+					cur.State = stateLeft
+					log.Printf("cluster: %s (%s) left", cur.NodeID, cur.Address)
+				} else {
+					cur.LastSeen = now
+				}
+			}
+		}
+		if cur.State == stateLeft {
+			s.dropLink(m.Address)
+			continue
+		}
+		s.ensureLink(m.Address)
+	}
+	s.clusterMu.Unlock()
+	if changed {
+		s.broadcastMembers()
+	}
+}
+
+// forgetSelf drops addr, discovered to reach this node, from links and members.
+func (s *Server) forgetSelf(addr string) {
+	s.clusterMu.Lock()
+	defer s.clusterMu.Unlock()
+	s.selfAddrs[addr] = true
+	s.dropLink(addr)
+	delete(s.members, addr)
+}
+
+// touchMember records a heartbeat from the peer at addr or with nodeID.
+func (s *Server) touchMember(addr, nodeID string) {
+	s.clusterMu.Lock()
+	defer s.clusterMu.Unlock()
+	now := time.Now()
+	for _, m := range s.members {
+		if (addr != "" && m.Address == addr) || (nodeID != "" && m.NodeID == nodeID) {
+			if m.State != stateLeft {
+				m.LastSeen = now
+			}
+		}
+	}
+}
+
+// memberLeft reports whether nodeID was removed from the cluster.
+func (s *Server) memberLeft(nodeID string) bool {
+	s.clusterMu.Lock()
+	defer s.clusterMu.Unlock()
+	for _, m := range s.members {
+		if m.NodeID == nodeID && m.State == stateLeft {
+			return true
+		}
+	}
+	return false
+}
+
+// memberList returns the known members with their current state, this node
+// first when it has a public address.
+func (s *Server) memberList() []member {
+	s.clusterMu.Lock()
+	defer s.clusterMu.Unlock()
+	now := time.Now().UTC()
+	out := make([]member, 0, len(s.members)+1)
+	if s.publicURL != "" {
+		out = append(out, member{NodeID: s.nodeID, Address: s.publicURL, LastSeen: now, State: stateAlive})
+	}
+	rest := make([]member, 0, len(s.members))
+	for _, m := range s.members {
+		cp := *m
+		cp.State = s.stateOf(m, now)
+		rest = append(rest, cp)
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].Address < rest[j].Address })
+	return append(out, rest...)
+}
+
+func (s *Server) peerLinks() []*peerLink {
+	s.clusterMu.Lock()
+	defer s.clusterMu.Unlock()
+	out := make([]*peerLink, 0, len(s.links))
+	for _, l := range s.links {
+		out = append(out, l)
+	}
+	return out
+}
+
+// liveLinks returns the streams to peers not considered dead.
+func (s *Server) liveLinks() []*peerLink {
+	s.clusterMu.Lock()
+	defer s.clusterMu.Unlock()
+	now := time.Now()
+	out := make([]*peerLink, 0, len(s.links))
+	for addr, l := range s.links {
+		if m, ok := s.members[addr]; ok && s.stateOf(m, now) == stateDead {
+			continue
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+func (s *Server) membersFrame() clusterFrame {
+	return clusterFrame{Type: "Members", NodeID: s.nodeID, Members: s.memberList()}
+}
+
+func (s *Server) broadcastMembers() {
+	f := s.membersFrame()
+	for _, l := range s.liveLinks() {
+		l.enqueue(f)
+	}
+}
+
+// runMembership tracks state changes, forgets long-dead members, drops expired
+// cluster keys and gossips the member list to a few random peers every gossipInterval.
+func (s *Server) runMembership(ctx context.Context) {
+	t := time.NewTicker(gossipInterval)
+	defer t.Stop()
+	prev := make(map[string]string)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		now := time.Now()
+		s.clusterMu.Lock()
+		for addr, m := range s.members {
+			st := s.stateOf(m, now)
+			if st != prev[addr] && prev[addr] != "" {
+				log.Printf("cluster: %s (%s) is %s", m.NodeID, addr, st)
+			}
+			prev[addr] = st
+			gone := (st == stateDead && now.Sub(m.LastSeen) > s.removeAfter) ||
+				(st == stateLeft && now.Sub(time.Unix(0, m.Updated)) > s.removeAfter)
+			if gone {
+				s.dropLink(addr)
+				delete(s.members, addr)
+				delete(prev, addr)
+			}
+		}
+		s.clusterMu.Unlock()
+		s.keys.prune()
+		links := s.liveLinks()
+		rand.Shuffle(len(links), func(i, j int) { links[i], links[j] = links[j], links[i] })
+		f := s.membersFrame()
+		for _, l := range links[:min(gossipFanout, len(links))] {
+			l.enqueue(f)
+		}
+	}
+}
+
+// startCluster opens a stream to every configured peer and to seed, the
+// members returned by a join.
+func (s *Server) startCluster(ctx context.Context, seed []member) {
+	s.clusterMu.Lock()
+	s.clusterCtx = ctx
+	ms := make([]member, 0, len(s.peers)+len(seed))
+	for _, p := range s.peers {
+		ms = append(ms, member{Address: p})
+	}
+	s.clusterMu.Unlock()
+	s.learnMembers(append(ms, seed...))
+	go s.runMembership(ctx)
+}
+
+// setPeers replaces the static peer list on reload: streams to peers no
+// longer listed are closed and new ones are dialled. Members learned through
+// gossip or joins are left alone.
+func (s *Server) setPeers(peers []string) {
+	keep := make(map[string]bool, len(peers))
+	ms := make([]member, 0, len(peers))
+	for _, p := range peers {
+		keep[normalizeAddress(p)] = true
+		ms = append(ms, member{Address: p})
+	}
+	s.clusterMu.Lock()
+	for _, p := range s.peers {
+		if addr := normalizeAddress(p); !keep[addr] {
+			s.dropLink(addr)
+			delete(s.members, addr)
+			log.Printf("cluster: peer %s removed from config", addr)
+		}
+	}
+	s.peers = peers
+	s.clusterMu.Unlock()
+	s.learnMembers(ms)
+}
+
+// clusterMembers serves GET /_cluster/members.
+func (s *Server) clusterMembers(w http.ResponseWriter, r *http.Request) {
+	if !s.adminView(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"members": s.memberList()})
+}
+
+// clusterHealthz serves GET /_cluster/healthz with member counts by state.
+func (s *Server) clusterHealthz(w http.ResponseWriter, r *http.Request) {
+	counts := map[string]int{stateAlive: 0, stateSuspect: 0, stateDead: 0}
+	for _, m := range s.memberList() {
+		if m.NodeID == s.nodeID || m.State == stateLeft {
+			continue
+		}
+		counts[m.State]++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "nodeId": s.nodeID, "peers": counts})
+}
+
+// removeMember serves DELETE /_cluster/members/{nodeId} for admins: the node
+// is marked left and the change is gossiped to the rest of the cluster.
+func (s *Server) removeMember(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	nodeID := chi.URLParam(r, "nodeId")
+	var found []member
+	for _, m := range s.memberList() {
+		if m.NodeID == nodeID && m.NodeID != s.nodeID {
+			m.State, m.Updated = stateLeft, time.Now().UnixNano()
+			found = append(found, m)
+		}
+	}
+	if len(found) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	s.learnMembers(found)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"ok":true}`))
+}
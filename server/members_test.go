@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newMemberServer returns a node whose peer links never dial.
+func newMemberServer() *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return &Server{
+		nodeID:       "self",
+		publicURL:    "http://self",
+		clusterCtx:   ctx,
+		links:        make(map[string]*peerLink),
+		members:      make(map[string]*member),
+		selfAddrs:    make(map[string]bool),
+		suspectAfter: 10 * time.Second,
+		deadAfter:    time.Minute,
+	}
+}
+
+func TestStateOf(t *testing.T) {
+	s := newMemberServer()
+	now := time.Now()
+	cases := []struct {
+		idle  time.Duration
+		state string
+		want  string
+	}{
+		{0, "", stateAlive},
+		{10 * time.Second, "", stateAlive},
+		{11 * time.Second, "", stateSuspect},
+		{time.Minute, "", stateSuspect},
+		{time.Minute + time.Second, "", stateDead},
+		{0, stateLeft, stateLeft},
+		{time.Hour, stateLeft, stateLeft},
+	}
+	for _, tc := range cases {
+		m := &member{LastSeen: now.Add(-tc.idle), State: tc.state}
+		if got := s.stateOf(m, now); got != tc.want {
+			t.Errorf("stateOf(idle %v, %q) = %s, want %s", tc.idle, tc.state, got, tc.want)
+		}
+	}
+}
+
+func TestLearnMembers(t *testing.T) {
+	s := newMemberServer()
+	s.learnMembers([]member{
+		{NodeID: "n2", Address: "http://a/"},
+		{NodeID: "n3", Address: "http://b"},
+		{NodeID: "self", Address: "http://elsewhere"},
+		{Address: "http://self"},
+		{NodeID: "n4", Address: "http://c", State: stateLeft, Updated: 1},
+	})
+	if got := linkAddrs(s.peerLinks()); got != "[http://a http://b]" {
+		t.Fatalf("links = %s, want [http://a http://b]", got)
+	}
+	if len(s.members) != 2 {
+		t.Fatalf("members = %d, want 2", len(s.members))
+	}
+
+	steps := []struct {
+		name string
+		m    member
+		left bool
+	}{
+		{"leave", member{NodeID: "n2", Address: "http://a", State: stateLeft, Updated: 200}, true},
+		{"older alive gossip", member{NodeID: "n2", Address: "http://a", Updated: 100}, true},
+		{"same-version alive gossip", member{NodeID: "n2", Address: "http://a", Updated: 200}, true},
+		{"rejoin", member{NodeID: "n2", Address: "http://a", Updated: 300}, false},
+		{"older leave gossip", member{NodeID: "n2", Address: "http://a", State: stateLeft, Updated: 250}, false},
+	}
+	for _, st := range steps {
+		s.learnMembers([]member{st.m})
+		s.clusterMu.Lock()
+		_, linked := s.links["http://a"]
+		s.clusterMu.Unlock()
+		if s.memberLeft("n2") != st.left || linked == st.left {
+			t.Fatalf("%s: left=%v linked=%v, want left=%v", st.name, s.memberLeft("n2"), linked, st.left)
+		}
+	}
+}
+
+func TestLiveLinksSkipDeadPeers(t *testing.T) {
+	s := newMemberServer()
+	s.learnMembers([]member{{NodeID: "n2", Address: "http://a"}, {NodeID: "n3", Address: "http://b"}, {NodeID: "n4", Address: "http://c"}})
+	s.clusterMu.Lock()
+	s.members["http://b"].LastSeen = time.Now().Add(-30 * time.Second)
+	s.members["http://c"].LastSeen = time.Now().Add(-2 * time.Minute)
+	s.clusterMu.Unlock()
+	if got := linkAddrs(s.liveLinks()); got != "[http://a http://b]" {
+		t.Fatalf("live links = %s, want alive and suspect peers only", got)
+	}
+	states := map[string]string{}
+	for _, m := range s.memberList() {
+		states[m.Address] = m.State
+	}
+	if states["http://a"] != stateAlive || states["http://b"] != stateSuspect || states["http://c"] != stateDead {
+		t.Fatalf("member states = %v", states)
+	}
+	// a heartbeat brings a dead peer back
+	s.touchMember("", "n4")
+	if got := linkAddrs(s.liveLinks()); got != "[http://a http://b http://c]" {
+		t.Fatalf("live links after heartbeat = %s", got)
+	}
+}
+
+func linkAddrs(links []*peerLink) string {
+	addrs := make([]string, 0, len(links))
+	for _, l := range links {
+		addrs = append(addrs, l.base)
+	}
+	sort.Strings(addrs)
+	return fmt.Sprint(addrs)
+}
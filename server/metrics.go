@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// otherChannel labels the channels beyond the metrics cardinality limit.
+const otherChannel = "_other"
+
+// hubStats are the counters of one channel label. Hubs past the cardinality
+// limit share the _other entry.
+type hubStats struct {
+	in, fanout, hubDrops, clientDrops, writeTimeouts, writeErrors atomic.Int64
+	subscribers                                                   atomic.Int64
+}
+
+// metrics is the registry behind /_metrics.
+type metrics struct {
+	start       time.Time
+	maxChannels int
+
+	mu       sync.Mutex
+	channels map[string]*hubStats
+	refs     map[string]int // live hubs using each channels entry
+	other    *hubStats
+	warned   bool
+}
+
+func newMetrics(maxChannels int) *metrics {
+	return &metrics{start: time.Now(), maxChannels: maxChannels, channels: make(map[string]*hubStats), refs: make(map[string]int), other: &hubStats{}}
+}
+
+// channel returns the stats for channel, or the shared _other entry while
+// maxChannels live channels hold a label. Each call is paired with release.
+func (m *metrics) channel(channel string) *hubStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if st, ok := m.channels[channel]; ok {
+		m.refs[channel]++
+		return st
+	}
+	if len(m.channels) >= m.maxChannels {
+		if !m.warned {
+			log.Printf("metrics: more than %d channels, the rest are labelled %s", m.maxChannels, otherChannel)
+			m.warned = true
+		}
+		return m.other
+	}
+	st := &hubStats{}
+	m.channels[channel] = st
+	m.refs[channel] = 1
+	return st
+}
+
+// release gives up a reaped hub's stats; the label is freed for another
+// channel once no live hub uses it, and its series restart from zero if the
+// channel comes back.
+func (m *metrics) release(channel string, st *hubStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.channels[channel] != st {
+		return
+	}
+	if m.refs[channel]--; m.refs[channel] <= 0 {
+		delete(m.channels, channel)
+		delete(m.refs, channel)
+	}
+}
+
+func metricsFromEnv() *metrics {
+	n := 200
+	if v, err := strconv.Atoi(os.Getenv("METRICS_MAX_CHANNELS")); err == nil && v >= 0 {
+		n = v
+	}
+	return newMetrics(n)
+}
+
+// metricsHandler serves GET /_metrics in the Prometheus text format. The
+// reserved prefix keeps /metrics free as a channel.
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.metricsView(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	m := s.metrics
+	m.mu.Lock()
+	names := make([]string, 0, len(m.channels)+1)
+	stats := make(map[string]*hubStats, len(m.channels)+1)
+	for ch, st := range m.channels {
+		names = append(names, ch)
+		stats[ch] = st
+	}
+	m.mu.Unlock()
+	sort.Strings(names)
+	names = append(names, otherChannel)
+	stats[otherChannel] = m.other
+
+	perChannel := []struct {
+		name, help, typ string
+		get             func(*hubStats) int64
+	}{
+		{"loghud_messages_in_total", "Messages published to a channel.", "counter", func(st *hubStats) int64 { return st.in.Load() }},
+		{"loghud_messages_fanout_total", "Messages queued to subscribers.", "counter", func(st *hubStats) int64 { return st.fanout.Load() }},
+		{"loghud_subscribers", "Connected subscribers.", "gauge", func(st *hubStats) int64 { return st.subscribers.Load() }},
+		{"loghud_write_timeouts_total", "Subscriber writes that timed out.", "counter", func(st *hubStats) int64 { return st.writeTimeouts.Load() }},
+		{"loghud_write_errors_total", "Subscriber writes that failed otherwise.", "counter", func(st *hubStats) int64 { return st.writeErrors.Load() }},
+	}
+	for _, pm := range perChannel {
+		writeMetricHeader(bw, pm.name, pm.help, pm.typ)
+		for _, ch := range names {
+			fmt.Fprintf(bw, "%s{channel=%s} %d\n", pm.name, labelValue(ch), pm.get(stats[ch]))
+		}
+	}
+	writeMetricHeader(bw, "loghud_messages_dropped_total", "Messages dropped because a queue was full.", "counter")
+	for _, ch := range names {
+		fmt.Fprintf(bw, "loghud_messages_dropped_total{channel=%s,reason=\"hub_queue\"} %d\n", labelValue(ch), stats[ch].hubDrops.Load())
+		fmt.Fprintf(bw, "loghud_messages_dropped_total{channel=%s,reason=\"client_queue\"} %d\n", labelValue(ch), stats[ch].clientDrops.Load())
+	}
+
+	peers := make([]peerStats, 0)
+	for _, l := range s.peerLinks() {
+		peers = append(peers, l.stats())
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	perPeer := []struct {
+		name, help, typ string
+		get             func(peerStats) int64
+	}{
+		{"loghud_peer_connected", "Whether the stream to a peer is up.", "gauge", func(p peerStats) int64 { return boolInt(p.Connected) }},
+		{"loghud_peer_forward_sent_total", "Messages sent to a peer.", "counter", func(p peerStats) int64 { return p.Sent }},
+		{"loghud_peer_forward_acked_total", "Messages acknowledged by a peer.", "counter", func(p peerStats) int64 { return p.Acked }},
+		{"loghud_peer_forward_failed_total", "Messages a peer rejected.", "counter", func(p peerStats) int64 { return p.Failed }},
+		{"loghud_peer_forward_dropped_total", "Messages dropped because the peer queue was full.", "counter", func(p peerStats) int64 { return p.Dropped }},
+		{"loghud_peer_queued", "Messages waiting to be sent to a peer.", "gauge", func(p peerStats) int64 { return int64(p.Queued) }},
+		{"loghud_peer_reconnects_total", "Reconnects of the stream to a peer.", "counter", func(p peerStats) int64 { return p.Reconnects }},
+	}
+	for _, pm := range perPeer {
+		writeMetricHeader(bw, pm.name, pm.help, pm.typ)
+		for _, p := range peers {
+			fmt.Fprintf(bw, "%s{peer=%s} %d\n", pm.name, labelValue(p.Address), pm.get(p))
+		}
+	}
+
+	s.mu.RLock()
+	live, dormant := len(s.hubs), len(s.dormant)
+	s.mu.RUnlock()
+	writeMetricHeader(bw, "loghud_channels", "Channel hubs by state.", "gauge")
+	fmt.Fprintf(bw, "loghud_channels{state=\"live\"} %d\n", live)
+	fmt.Fprintf(bw, "loghud_channels{state=\"dormant\"} %d\n", dormant)
+
+	d := s.dedup.stats()
+	writeMetricHeader(bw, "loghud_duplicates_suppressed_total", "Envelopes dropped as already published.", "counter")
+	fmt.Fprintf(bw, "loghud_duplicates_suppressed_total{source=\"client\"} %d\n", d.FromClients)
+	fmt.Fprintf(bw, "loghud_duplicates_suppressed_total{source=\"peer\"} %d\n", d.FromPeers)
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	gauge := func(name, help string, v any) {
+		writeMetricHeader(bw, name, help, "gauge")
+		fmt.Fprintf(bw, "%s %v\n", name, v)
+	}
+	gauge("go_goroutines", "Number of goroutines.", runtime.NumGoroutine())
+	gauge("go_memstats_alloc_bytes", "Bytes of allocated heap objects.", ms.Alloc)
+	gauge("go_memstats_sys_bytes", "Bytes obtained from the OS.", ms.Sys)
+	gauge("go_memstats_heap_objects", "Number of allocated heap objects.", ms.HeapObjects)
+	writeMetricHeader(bw, "go_gc_cycles_total", "Completed GC cycles.", "counter")
+	fmt.Fprintf(bw, "go_gc_cycles_total %d\n", ms.NumGC)
+	writeMetricHeader(bw, "go_gc_pause_seconds_total", "Total GC pause time.", "counter")
+	fmt.Fprintf(bw, "go_gc_pause_seconds_total %g\n", float64(ms.PauseTotalNs)/1e9)
+	gauge("process_start_time_seconds", "Start time of the process since the unix epoch.", m.start.Unix())
+}
+
+func writeMetricHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsLabelsFreedOnRelease(t *testing.T) {
+	m := newMetrics(2)
+	a, b := m.channel("/a"), m.channel("/b")
+	if m.channel("/c") != m.other {
+		t.Fatal("third channel got a label past the limit")
+	}
+	if m.channel("/a") != a {
+		t.Fatal("second hub for /a got separate stats")
+	}
+	m.release("/a", a)
+	m.release("/b", b)
+	m.release("/c", m.other)
+	if m.channel("/d") == m.other {
+		t.Fatal("released label was not reused")
+	}
+	if m.channel("/e") != m.other {
+		t.Fatal("label of /a freed while a hub still used it")
+	}
+}
+
+func TestMetricsViewPermission(t *testing.T) {
+	s := &Server{admin: "root", metrics: newMetrics(1)}
+	s.auth.Store(&authConfig{static: map[string]*principal{
+		"scraper": {Sub: "scraper", Perms: []string{permMetrics}},
+		"viewer":  {Sub: "viewer", Perms: []string{permSubscribe}},
+	}})
+	cases := []struct {
+		token string
+		want  bool
+	}{
+		{"root", true},
+		{"scraper", true},
+		{"viewer", false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/_metrics", nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		if got := s.metricsView(httptest.NewRecorder(), r); got != tc.want {
+			t.Errorf("metricsView(%q) = %v, want %v", tc.token, got, tc.want)
+		}
+		if tc.token == "scraper" && s.isAdmin(r) {
+			t.Error("metrics token passes as admin")
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// muxMaxSubs caps the subscriptions held by one multiplexed socket.
+const muxMaxSubs = 256
+
+// muxFrame is a control frame sent by a client on /_ws:
+//
+//	{"op":"subscribe","id":"1","channel":"/logs/**","last":50,"filter":{"level":"error"}}
+//	{"op":"unsubscribe","id":"2","channel":"/logs/**"}
+//	{"op":"publish","id":"3","channel":"/logs/app1","data":{"message":"hi"}}
+//	{"op":"ping","id":"4"}
+type muxFrame struct {
+	Op      string          `json:"op"`
+	ID      string          `json:"id,omitempty"`
+	Channel string          `json:"channel,omitempty"`
+	Since   string          `json:"since,omitempty"`
+	Last    *int            `json:"last,omitempty"`
+	Filter  *muxFilter      `json:"filter,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// muxFilter mirrors the ?level=&where=&fields= query of channel sockets.
+type muxFilter struct {
+	Level  string   `json:"level,omitempty"`
+	Where  []string `json:"where,omitempty"`
+	Fields string   `json:"fields,omitempty"`
+}
+
+// muxReply is sent back for every control frame: op is "ack", "pong" or "error".
+type muxReply struct {
+	Op        string `json:"op"`
+	ID        string `json:"id,omitempty"`
+	Channel   string `json:"channel,omitempty"`
+	MsgID     string `json:"msgId,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// publishReply acknowledges the result of ingest for a socket publisher.
+func publishReply(id, channel string, env []byte, err error) muxReply {
+	if err != nil && err != errDuplicate {
+		return muxReply{Op: "error", ID: id, Channel: channel, Error: err.Error()}
+	}
+	m, _ := parseMeta(env)
+	return muxReply{Op: "ack", ID: id, Channel: channel, MsgID: m.ID, Duplicate: err == errDuplicate}
+}
+
+// muxSocket serves the multiplexed protocol: one WebSocket following many
+// channels. Deliveries are framed as {"op":"message","channel":<subscription>,"data":<envelope>}.
+func (s *Server) muxSocket(w http.ResponseWriter, r *http.Request) {
+	p, err := s.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: []string{"*"}})
+	if err != nil {
+		log.Println("ws accept:", err)
+		return
+	}
+	c.SetReadLimit(maxBodyBytes + 4096)
+	subs := make(map[string]*Hub)
+	defer func() {
+		for _, h := range subs {
+			h.Remove(c)
+		}
+		_ = c.Close(websocket.StatusNormalClosure, "bye")
+	}()
+	for {
+		typ, data, err := c.Read(r.Context())
+		if err != nil {
+			return
+		}
+		if typ != websocket.MessageText {
+			continue
+		}
+		var f muxFrame
+		if err := json.Unmarshal(data, &f); err != nil {
+			writeMuxReply(c, muxReply{Op: "error", Error: "invalid frame"})
+			continue
+		}
+		writeMuxReply(c, s.muxHandle(r.Context(), c, p, clientIP(r), subs, f))
+	}
+}
+
+func (s *Server) muxHandle(ctx context.Context, c *websocket.Conn, p *principal, ip string, subs map[string]*Hub, f muxFrame) muxReply {
+	fail := func(msg string) muxReply { return muxReply{Op: "error", ID: f.ID, Channel: f.Channel, Error: msg} }
+	if f.Op == "ping" {
+		return muxReply{Op: "pong", ID: f.ID}
+	}
+	channel := "/" + strings.Trim(f.Channel, "/")
+	if channel == "/" {
+		return fail("channel required")
+	}
+	switch f.Op {
+	case "subscribe":
+		if !p.can(permSubscribe, channel) {
+			return fail("forbidden")
+		}
+		if _, ok := subs[channel]; !ok && len(subs) >= muxMaxSubs {
+			return fail("too many subscriptions")
+		}
+		sub, err := f.subscription(channel)
+		if err != nil {
+			return fail(err.Error())
+		}
+		if h, ok := subs[channel]; ok {
+			// re-subscribing replaces the filter
+			h.Remove(c)
+		}
+		h, err := s.subscribe(channel, c, sub)
+		if err != nil {
+			delete(subs, channel)
+			return fail(err.Error())
+		}
+		subs[channel] = h
+		return muxReply{Op: "ack", ID: f.ID, Channel: channel}
+	case "unsubscribe":
+		if h, ok := subs[channel]; ok {
+			h.Remove(c)
+			delete(subs, channel)
+		}
+		return muxReply{Op: "ack", ID: f.ID, Channel: channel}
+	case "publish":
+		if !p.can(permPublish, channel) {
+			return fail("forbidden")
+		}
+		if len(f.Data) == 0 {
+			return fail("data required")
+		}
+		if err := s.admit(p, ip, channel, len(f.Data)); err != nil {
+			return fail(err.Error())
+		}
+		env, err := s.ingest(ctx, channel, f.Data, false)
+		return publishReply(f.ID, channel, env, err)
+	default:
+		return fail("unknown op")
+	}
+}
+
+func (f muxFrame) subscription(channel string) (subscription, error) {
+	last := ""
+	if f.Last != nil {
+		last = strconv.Itoa(*f.Last)
+	}
+	sub := subscription{replay: parseReplayQuery(f.Since, last), wrap: muxWrap(channel)}
+	if f.Filter != nil {
+		q := url.Values{}
+		if f.Filter.Level != "" {
+			q.Set("level", f.Filter.Level)
+		}
+		if f.Filter.Fields != "" {
+			q.Set("fields", f.Filter.Fields)
+		}
+		q["where"] = f.Filter.Where
+		filter, err := parseSubFilter(q)
+		if err != nil {
+			return sub, err
+		}
+		sub.filter = filter
+	}
+	return sub, nil
+}
+
+func muxWrap(channel string) func([]byte) []byte {
+	prefix, _ := json.Marshal(channel)
+	head := append([]byte(`{"op":"message","channel":`), prefix...)
+	head = append(head, `,"data":`...)
+	return func(msg []byte) []byte {
+		out := make([]byte, 0, len(head)+len(msg)+1)
+		out = append(append(out, head...), msg...)
+		return append(out, '}')
+	}
+}
+
+func writeMuxReply(c *websocket.Conn, rep muxReply) {
+	b, err := json.Marshal(rep)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_ = c.Write(ctx, websocket.MessageText, b)
+}
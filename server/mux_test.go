@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// newSocketServer serves s's channel and mux sockets and returns their ws:// base URL.
+func newSocketServer(t *testing.T, s *Server) string {
+	t.Helper()
+	if s.hubs == nil {
+		s.hubs = make(map[string]*Hub)
+		s.patterns = make(map[string]*Hub)
+		s.dormant = make(map[string]dormantRing)
+	}
+	if s.keys == nil {
+		s.keys = newKeyring(1, []byte("k"))
+	}
+	if s.dedup == nil {
+		s.dedup = newDedupCache(1000, time.Minute)
+	}
+	if s.metrics == nil {
+		s.metrics = newMetrics(1000)
+	}
+	if s.limits.Load() == nil {
+		s.limits.Store(&limits{})
+	}
+	s.nodeID, s.replayMax, s.replayAge = "n1", 100, time.Hour
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_ws", s.muxSocket)
+	mux.HandleFunc("/", s.anyChannel)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+// muxIn is any frame the server sends on a socket.
+type muxIn struct {
+	Op        string          `json:"op"`
+	ID        string          `json:"id"`
+	Channel   string          `json:"channel"`
+	MsgID     string          `json:"msgId"`
+	Duplicate bool            `json:"duplicate"`
+	Error     string          `json:"error"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// text is the message field of a delivered envelope.
+func (f muxIn) text() string {
+	var m struct{ Message string }
+	_ = json.Unmarshal(f.Data, &m)
+	return m.Message
+}
+
+type testSocket struct {
+	t *testing.T
+	c *websocket.Conn
+}
+
+func dialSocket(t *testing.T, url, token string) *testSocket {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := &websocket.DialOptions{HTTPHeader: http.Header{}}
+	if token != "" {
+		opts.HTTPHeader.Set("Authorization", "Bearer "+token)
+	}
+	c, _, err := websocket.Dial(ctx, url, opts)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	t.Cleanup(func() { _ = c.Close(websocket.StatusNormalClosure, "") })
+	return &testSocket{t, c}
+}
+
+func (s *testSocket) write(v any) {
+	s.t.Helper()
+	b, ok := v.([]byte)
+	if !ok {
+		b, _ = json.Marshal(v)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.c.Write(ctx, websocket.MessageText, b); err != nil {
+		s.t.Fatalf("write: %v", err)
+	}
+}
+
+func (s *testSocket) read() muxIn {
+	s.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, b, err := s.c.Read(ctx)
+	if err != nil {
+		s.t.Fatalf("read: %v", err)
+	}
+	var f muxIn
+	if err := json.Unmarshal(b, &f); err != nil {
+		s.t.Fatalf("frame %s: %v", b, err)
+	}
+	return f
+}
+
+// call sends f and returns its reply and the messages delivered before it.
+func (s *testSocket) call(f muxFrame) (muxIn, []muxIn) {
+	s.t.Helper()
+	s.write(f)
+	var msgs []muxIn
+	for {
+		in := s.read()
+		if in.Op == "message" {
+			msgs = append(msgs, in)
+			continue
+		}
+		return in, msgs
+	}
+}
+
+// message reads until the next delivered message.
+func (s *testSocket) message() muxIn {
+	s.t.Helper()
+	for {
+		if in := s.read(); in.Op == "message" {
+			return in
+		}
+	}
+}
+
+func intp(n int) *int { return &n }
+
+func TestMuxSocket(t *testing.T) {
+	s := &Server{}
+	base := newSocketServer(t, s)
+	for _, msg := range []string{`{"level":"info","message":"a"}`, `{"level":"error","message":"b"}`} {
+		if _, err := s.ingest(context.Background(), "/logs/app", json.RawMessage(msg), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ws := dialSocket(t, base+"/_ws", "")
+
+	if rep, _ := ws.call(muxFrame{Op: "ping", ID: "p"}); rep.Op != "pong" || rep.ID != "p" {
+		t.Fatalf("ping = %+v", rep)
+	}
+
+	// subscribe replays the filtered history of the matching channels
+	rep, msgs := ws.call(muxFrame{Op: "subscribe", ID: "1", Channel: "/logs/**", Last: intp(10), Filter: &muxFilter{Level: "error"}})
+	if rep.Op != "ack" || rep.ID != "1" || rep.Channel != "/logs/**" {
+		t.Fatalf("subscribe = %+v", rep)
+	}
+	if len(msgs) == 0 {
+		msgs = append(msgs, ws.message())
+	}
+	if m := msgs[0]; m.Channel != "/logs/**" || m.text() != "b" {
+		t.Fatalf("replayed %q on %s, want b on /logs/**", m.text(), m.Channel)
+	}
+
+	// publishes are acked; the filtered one is never delivered
+	rep, _ = ws.call(muxFrame{Op: "publish", ID: "2", Channel: "/logs/app", Data: json.RawMessage(`{"level":"info","message":"c"}`)})
+	if rep.Op != "ack" || rep.ID != "2" || rep.MsgID == "" {
+		t.Fatalf("publish = %+v", rep)
+	}
+	ws.call(muxFrame{Op: "publish", ID: "3", Channel: "/logs/app", Data: json.RawMessage(`{"level":"error","message":"d"}`)})
+	if m := ws.message(); m.text() != "d" {
+		t.Fatalf("delivered %q, want d", m.text())
+	}
+
+	// re-subscribing replaces the filter
+	if rep, _ = ws.call(muxFrame{Op: "subscribe", ID: "4", Channel: "/logs/**", Last: intp(0), Filter: &muxFilter{Level: "info"}}); rep.Op != "ack" {
+		t.Fatalf("re-subscribe = %+v", rep)
+	}
+	ws.call(muxFrame{Op: "publish", ID: "5", Channel: "/logs/app", Data: json.RawMessage(`{"level":"error","message":"e"}`)})
+	ws.call(muxFrame{Op: "publish", ID: "6", Channel: "/logs/app", Data: json.RawMessage(`{"level":"info","message":"f"}`)})
+	if m := ws.message(); m.text() != "f" {
+		t.Fatalf("delivered %q after re-subscribe, want f", m.text())
+	}
+
+	// nothing arrives after unsubscribe
+	if rep, _ = ws.call(muxFrame{Op: "unsubscribe", ID: "7", Channel: "/logs/**"}); rep.Op != "ack" || rep.ID != "7" {
+		t.Fatalf("unsubscribe = %+v", rep)
+	}
+	ws.call(muxFrame{Op: "publish", ID: "8", Channel: "/logs/app", Data: json.RawMessage(`{"level":"info","message":"g"}`)})
+	if rep, msgs = ws.call(muxFrame{Op: "ping", ID: "9"}); rep.Op != "pong" || len(msgs) != 0 {
+		t.Fatalf("after unsubscribe got %d messages", len(msgs))
+	}
+
+	errs := []struct {
+		frame muxFrame
+		want  string
+	}{
+		{muxFrame{Op: "publish", ID: "10", Channel: "/logs/**", Data: json.RawMessage(`{}`)}, "cannot publish to a channel pattern"},
+		{muxFrame{Op: "publish", ID: "11", Channel: "/logs/app"}, "data required"},
+		{muxFrame{Op: "subscribe", ID: "12"}, "channel required"},
+		{muxFrame{Op: "subscribe", ID: "13", Channel: "/logs/app", Filter: &muxFilter{Where: []string{"no-operator"}}}, ""},
+		{muxFrame{Op: "shout", ID: "14", Channel: "/logs/app"}, "unknown op"},
+	}
+	for _, tc := range errs {
+		rep, _ := ws.call(tc.frame)
+		if rep.Op != "error" || rep.ID != tc.frame.ID || (tc.want != "" && rep.Error != tc.want) {
+			t.Errorf("%s %s = %+v, want error %q", tc.frame.Op, tc.frame.Channel, rep, tc.want)
+		}
+	}
+	ws.write([]byte(`not json`))
+	if rep := ws.read(); rep.Op != "error" || rep.Error != "invalid frame" {
+		t.Errorf("invalid frame = %+v", rep)
+	}
+}
+
+func TestMuxSocketPermissions(t *testing.T) {
+	s := &Server{}
+	s.auth.Store(&authConfig{static: map[string]*principal{
+		"reader": {Perms: []string{permSubscribe}, Channels: []string{"/logs/a"}},
+	}})
+	base := newSocketServer(t, s)
+	ws := dialSocket(t, base+"/_ws", "reader")
+	for _, f := range []muxFrame{
+		{Op: "subscribe", ID: "1", Channel: "/logs/**"},
+		{Op: "subscribe", ID: "2", Channel: "/logs/b"},
+		{Op: "publish", ID: "3", Channel: "/logs/a", Data: json.RawMessage(`{}`)},
+	} {
+		if rep, _ := ws.call(f); rep.Op != "error" || rep.Error != "forbidden" {
+			t.Errorf("%s %s = %+v, want forbidden", f.Op, f.Channel, rep)
+		}
+	}
+	if rep, _ := ws.call(muxFrame{Op: "subscribe", ID: "4", Channel: "/logs/a"}); rep.Op != "ack" {
+		t.Errorf("granted subscribe = %+v", rep)
+	}
+}
+
+func TestMuxSocketSubscriptionCap(t *testing.T) {
+	base := newSocketServer(t, &Server{})
+	ws := dialSocket(t, base+"/_ws", "")
+	for i := 0; i < muxMaxSubs; i++ {
+		if rep, _ := ws.call(muxFrame{Op: "subscribe", ID: fmt.Sprint(i), Channel: fmt.Sprintf("/c/%d", i)}); rep.Op != "ack" {
+			t.Fatalf("subscribe %d = %+v", i, rep)
+		}
+	}
+	if rep, _ := ws.call(muxFrame{Op: "subscribe", ID: "over", Channel: "/c/over"}); rep.Op != "error" || rep.Error != "too many subscriptions" {
+		t.Fatalf("subscription past the cap = %+v", rep)
+	}
+	// re-subscribing at the cap replaces rather than adds
+	if rep, _ := ws.call(muxFrame{Op: "subscribe", ID: "again", Channel: "/c/0", Last: intp(0)}); rep.Op != "ack" {
+		t.Fatalf("re-subscribe at the cap = %+v", rep)
+	}
+	ws.call(muxFrame{Op: "unsubscribe", ID: "u", Channel: "/c/1"})
+	if rep, _ := ws.call(muxFrame{Op: "subscribe", ID: "room", Channel: "/c/over"}); rep.Op != "ack" {
+		t.Fatalf("subscribe after unsubscribe = %+v", rep)
+	}
+}
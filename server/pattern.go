@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// matchChannel reports whether channel matches pattern, where a "*" segment
+// matches exactly one path segment and a "**" segment matches any number of them.
+func matchChannel(pattern, channel string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == channel
+	}
+	return matchSegments(splitChannel(pattern), splitChannel(channel))
+}
+
+func matchSegments(pat, segs []string) bool {
+	for len(pat) > 0 {
+		switch pat[0] {
+		case "**":
+			if len(pat) == 1 {
+				return true
+			}
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pat[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(segs) == 0 {
+				return false
+			}
+		default:
+			if len(segs) == 0 || pat[0] != segs[0] {
+				return false
+			}
+		}
+		pat, segs = pat[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// coversChannel reports whether every channel matched by channel, itself
+// possibly a pattern, is also matched by pattern.
+func coversChannel(pattern, channel string) bool {
+	if !isPattern(channel) {
+		return matchChannel(pattern, channel)
+	}
+	return coverSegments(splitChannel(pattern), splitChannel(channel))
+}
+
+func coverSegments(pat, segs []string) bool {
+	for len(pat) > 0 {
+		switch pat[0] {
+		case "**":
+			if len(pat) == 1 {
+				return true
+			}
+			for i := 0; i <= len(segs); i++ {
+				if coverSegments(pat[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(segs) == 0 || segs[0] == "**" {
+				return false
+			}
+		default:
+			if len(segs) == 0 || pat[0] != segs[0] {
+				return false
+			}
+		}
+		pat, segs = pat[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+func splitChannel(ch string) []string {
+	ch = strings.Trim(ch, "/")
+	if ch == "" {
+		return nil
+	}
+	return strings.Split(ch, "/")
+}
+
+func isPattern(channel string) bool {
+	return strings.Contains(channel, "*")
+}
+
+// seedSyncTimeout bounds how long a new pattern hub waits for the channels
+// it matches to push what they had queued when it was registered.
+const seedSyncTimeout = time.Second
+
+// seedDedupFor is how long a pattern hub drops live copies of envelopes it
+// was seeded with; only publishes in flight while it was created have one.
+const seedDedupFor = time.Minute
+
+// patternSources returns the replay rings of the live and reaped concrete
+// channels matching pattern, and the live hubs among them. Caller holds s.mu.
+func (s *Server) patternSources(pattern string) ([]*replayRing, []*Hub) {
+	var srcs []*replayRing
+	var live []*Hub
+	for ch, h := range s.hubs {
+		if !isPattern(ch) && matchChannel(pattern, ch) {
+			srcs = append(srcs, h.replay)
+			live = append(live, h)
+		}
+	}
+	for ch, d := range s.dormant {
+		if _, ok := s.hubs[ch]; !ok && !isPattern(ch) && matchChannel(pattern, ch) {
+			srcs = append(srcs, d.ring)
+		}
+	}
+	return srcs, live
+}
+
+// seedPattern fills a new pattern hub's replay with the recent history of
+// srcs, merged with what the hub kept from before it was reaped. A publisher
+// that looked up patterns before h was registered reaches it only through
+// its channel's ring, so the live sources are first given time to push what
+// they had queued. A publisher that found h may also deliver an envelope
+// that was seeded; h remembers the seeded ids to drop that copy. Caller holds
+// h.mu but not s.mu, so this stalls only h.
+func seedPattern(h *Hub, srcs []*replayRing, live []*Hub) {
+	if h.replay == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), seedSyncTimeout)
+	defer cancel()
+	var synced []chan struct{}
+	for _, src := range live {
+		if done := src.mark(ctx); done != nil {
+			synced = append(synced, done)
+		}
+	}
+	for _, done := range synced {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+	h.replay = mergeRings(h.replay.max, h.replay.maxAge, append(srcs, h.replay))
+	h.seeded = make(map[string]bool)
+	for _, e := range h.replay.entries() {
+		if e.id != "" {
+			h.seeded[e.id] = true
+		}
+	}
+	h.seededUntil = time.Now().Add(seedDedupFor)
+}
+
+// mark queues a marker behind everything already in h's queue and returns
+// the channel run closes when it gets there, or nil if h is reaped or the
+// queue stays full until ctx is done.
+func (h *Hub) mark(ctx context.Context) chan struct{} {
+	h.mu.RLock()
+	if h.closed {
+		h.mu.RUnlock()
+		return nil
+	}
+	// counted like a waiting publisher so the reaper leaves h.in open
+	h.waiting.Add(1)
+	h.mu.RUnlock()
+	defer h.waiting.Add(-1)
+	done := make(chan struct{})
+	select {
+	case h.in <- hubMsg{reached: done}:
+		return done
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// dropSeeded reports whether msg is a live copy of an envelope h was seeded
+// with. Caller is run.
+func (h *Hub) dropSeeded(msg []byte) bool {
+	if time.Now().After(h.seededUntil) {
+		h.seeded = nil
+		return false
+	}
+	m, _ := parseMeta(msg)
+	if m.ID == "" || !h.seeded[m.ID] {
+		return false
+	}
+	delete(h.seeded, m.ID)
+	return true
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestMatchChannel(t *testing.T) {
+	cases := []struct {
+		pattern, channel string
+		want             bool
+	}{
+		{"/logs/app", "/logs/app", true},
+		{"/logs/app", "/logs/app2", false},
+		{"/logs/*", "/logs/app", true},
+		{"/logs/*", "/logs", false},
+		{"/logs/*", "/logs/app/web", false},
+		{"/logs/*/web", "/logs/app/web", true},
+		{"/logs/*/web", "/logs/app/db", false},
+		{"/logs/**", "/logs", true},
+		{"/logs/**", "/logs/app", true},
+		{"/logs/**", "/logs/app/web/1", true},
+		{"/logs/**", "/logsx/app", false},
+		{"/**", "/anything/at/all", true},
+		{"/**/error", "/error", true},
+		{"/**/error", "/logs/app/error", true},
+		{"/**/error", "/logs/app/error/x", false},
+		{"/a/**/z", "/a/z", true},
+		{"/a/**/z", "/a/b/c/z", true},
+		{"/a/**/z", "/a/b/c", false},
+		{"/*", "/", false},
+	}
+	for _, tc := range cases {
+		if got := matchChannel(tc.pattern, tc.channel); got != tc.want {
+			t.Errorf("matchChannel(%q, %q) = %v, want %v", tc.pattern, tc.channel, got, tc.want)
+		}
+	}
+}
+
+func TestCoversChannel(t *testing.T) {
+	cases := []struct {
+		pattern, channel string
+		want             bool
+	}{
+		{"/logs/**", "/logs/app", true},
+		{"/logs/**", "/logs/*", true},
+		{"/logs/**", "/logs/**", true},
+		{"/logs/**", "/logs/app/**", true},
+		{"/logs/**", "/**", false},
+		{"/logs/*", "/logs/*", true},
+		{"/logs/*", "/logs/**", false},
+		{"/logs/*", "/logs/app", true},
+		{"/logs/*", "/*/app", false},
+		{"/logs/app", "/logs/*", false},
+		{"/logs/app", "/logs/app", true},
+		{"/**", "/**", true},
+		{"/*/app", "/logs/app", true},
+		{"/*/app", "/*/app", true},
+		{"/*/app", "/**/app", false},
+		{"/secure/**", "/logs/**", false},
+	}
+	for _, tc := range cases {
+		if got := coversChannel(tc.pattern, tc.channel); got != tc.want {
+			t.Errorf("coversChannel(%q, %q) = %v, want %v", tc.pattern, tc.channel, got, tc.want)
+		}
+	}
+}
+
+func TestSeedPatternMergesNewest(t *testing.T) {
+	old := time.Now().Add(-9 * time.Minute)
+	ring := func(max int, ids ...int64) *replayRing {
+		r := newReplayRing(max, 10*time.Minute)
+		for _, ns := range ids {
+			r.buf[r.n] = replayEntry{id: fmt.Sprint("id-", ns), unixNs: ns, at: old, msg: []byte(fmt.Sprint(ns))}
+			r.n++
+		}
+		return r
+	}
+	h := NewHub(4, 10*time.Minute)
+	h.replay = ring(4, 3, 6) // kept from before the pattern hub was reaped
+	seedPattern(h, []*replayRing{ring(4, 1, 4, 7), ring(4, 2, 5, 6, 8), nil}, nil)
+	var got []string
+	for _, e := range h.replay.entries() {
+		got = append(got, string(e.msg))
+		if !e.at.Equal(old) {
+			t.Errorf("entry %s re-stamped at %v, want %v", e.msg, e.at, old)
+		}
+	}
+	if want := []string{"5", "6", "7", "8"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("seeded replay = %v, want %v", got, want)
+	}
+}
+
+func TestSeedPatternInFlightPublishes(t *testing.T) {
+	s := &Server{keys: newKeyring(1, []byte("k")), nodeID: "n1"}
+	env := func(msg string) []byte {
+		b, err := s.injectMeta("/logs/a", []byte(`{"message":"`+msg+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	// queued on its channel but not yet in the channel's ring
+	src := NewHub(10, time.Minute)
+	queued := env("queued")
+	src.Broadcast(context.Background(), queued)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		src.run()
+	}()
+	h := NewHub(10, time.Minute)
+	seedPattern(h, []*replayRing{src.replay}, []*Hub{src})
+	src.close()
+	if got := h.replay.snapshot(replayQuery{last: -1}); len(got) != 1 || string(got[0]) != string(queued) {
+		t.Fatalf("seeded replay = %q, want the queued envelope", got)
+	}
+
+	// a publisher that found the new hub delivers the seeded envelope again
+	conn := &websocket.Conn{}
+	c := &client{conn: conn, send: make(chan outMsg, 4), done: make(chan struct{})}
+	h.clients[conn] = c
+	h.fanout(hubMsg{data: queued})
+	if len(c.send) != 0 || len(h.replay.snapshot(replayQuery{last: -1})) != 1 {
+		t.Fatal("seeded envelope delivered and stored twice")
+	}
+	later := env("later")
+	h.fanout(hubMsg{data: later})
+	if m := <-c.send; string(m.data) != string(later) {
+		t.Fatalf("live envelope = %s, want %s", m.data, later)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limitError is a publish refused by a rate limit or quota; it maps to 429
+// with Retry-After.
+type limitError struct {
+	msg   string
+	retry time.Duration
+}
+
+func (e *limitError) Error() string { return e.msg }
+
+func (e *limitError) retryAfter() string {
+	return strconv.Itoa(max(int(math.Ceil(e.retry.Seconds())), 1))
+}
+
+// tokenBucket limits each key to rate events per second with bursts up to burst.
+type tokenBucket struct {
+	rate, burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, buckets: make(map[string]*bucket)}
+}
+
+// take spends one token for key, or reports how long until one is available.
+func (tb *tokenBucket) take(key string, now time.Time) (bool, time.Duration) {
+	if tb == nil {
+		return true, 0
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if now.Sub(tb.swept) > time.Minute {
+		tb.sweep(now)
+	}
+	b, ok := tb.buckets[key]
+	if !ok {
+		b = &bucket{tokens: tb.burst, last: now}
+		tb.buckets[key] = b
+	}
+	b.tokens = min(tb.burst, b.tokens+now.Sub(b.last).Seconds()*tb.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / tb.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// refund returns a token taken for key to its bucket.
+func (tb *tokenBucket) refund(key string) {
+	if tb == nil {
+		return
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if b, ok := tb.buckets[key]; ok {
+		b.tokens = min(tb.burst, b.tokens+1)
+	}
+}
+
+// sweep forgets buckets that have refilled completely. Caller holds tb.mu.
+func (tb *tokenBucket) sweep(now time.Time) {
+	tb.swept = now
+	for k, b := range tb.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*tb.rate >= tb.burst {
+			delete(tb.buckets, k)
+		}
+	}
+}
+
+// parseRate reads "100/s", "6000/m" or "50000/h", optionally followed by
+// ":burst". The burst defaults to the count, but at least one message so a
+// fractional rate such as "0.5/s" still lets messages through.
+func parseRate(v string) (rate, burst float64, err error) {
+	spec, b, hasBurst := strings.Cut(v, ":")
+	n, unit, ok := strings.Cut(spec, "/")
+	count, err := strconv.ParseFloat(n, 64)
+	if !ok || err != nil || count <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate %q: want count/s|m|h[:burst]", v)
+	}
+	per := map[string]float64{"s": 1, "m": 60, "h": 3600}[unit]
+	if per == 0 {
+		return 0, 0, fmt.Errorf("invalid rate unit in %q", v)
+	}
+	burst = max(count, 1)
+	if hasBurst {
+		if burst, err = strconv.ParseFloat(b, 64); err != nil || burst < 1 {
+			return 0, 0, fmt.Errorf("invalid burst in %q", v)
+		}
+	}
+	return count / per, burst, nil
+}
+
+func rateEnv(key string) (*tokenBucket, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil, nil
+	}
+	rate, burst, err := parseRate(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return newTokenBucket(rate, burst), nil
+}
+
+// dailyQuota counts messages and bytes per identity for the current UTC day.
+type dailyQuota struct {
+	maxMsgs, maxBytes int64
+
+	mu    sync.Mutex
+	day   string
+	usage map[string]*quotaUsage
+}
+
+type quotaUsage struct{ msgs, bytes int64 }
+
+// charge adds one message of size bytes to key, refusing it once either
+// daily limit would be exceeded.
+func (q *dailyQuota) charge(key string, size int, now time.Time) (bool, time.Duration) {
+	if q == nil {
+		return true, 0
+	}
+	now = now.UTC()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if day := now.Format(time.DateOnly); day != q.day {
+		q.day, q.usage = day, make(map[string]*quotaUsage)
+	}
+	u, ok := q.usage[key]
+	if !ok {
+		u = &quotaUsage{}
+		q.usage[key] = u
+	}
+	if (q.maxMsgs > 0 && u.msgs+1 > q.maxMsgs) || (q.maxBytes > 0 && u.bytes+int64(size) > q.maxBytes) {
+		y, m, d := now.Date()
+		return false, time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC).Sub(now)
+	}
+	u.msgs++
+	u.bytes += int64(size)
+	return true, 0
+}
+
+// adopt carries today's usage over from prev, so a reload does not reset quotas.
+func (q *dailyQuota) adopt(prev *dailyQuota) {
+	if q == nil || prev == nil {
+		return
+	}
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.day = prev.day
+	q.usage = make(map[string]*quotaUsage, len(prev.usage))
+	for k, u := range prev.usage {
+		cp := *u
+		q.usage[k] = &cp
+	}
+}
+
+// limits are the publish limits configured by RATE_LIMIT_* and QUOTA_DAILY_*.
+type limits struct {
+	identity, ip, channel *tokenBucket
+	quota                 *dailyQuota
+}
+
+func limitsFromEnv() (*limits, error) {
+	l := &limits{}
+	var err error
+	if l.identity, err = rateEnv("RATE_LIMIT_IDENTITY"); err != nil {
+		return nil, err
+	}
+	if l.ip, err = rateEnv("RATE_LIMIT_IP"); err != nil {
+		return nil, err
+	}
+	if l.channel, err = rateEnv("RATE_LIMIT_CHANNEL"); err != nil {
+		return nil, err
+	}
+	var msgs, bytes int64
+	if v := os.Getenv("QUOTA_DAILY_MESSAGES"); v != "" {
+		if msgs, err = strconv.ParseInt(v, 10, 64); err != nil || msgs < 0 {
+			return nil, fmt.Errorf("QUOTA_DAILY_MESSAGES: invalid count %q", v)
+		}
+	}
+	if v := os.Getenv("QUOTA_DAILY_BYTES"); v != "" {
+		if bytes, err = parseSize(v); err != nil {
+			return nil, fmt.Errorf("QUOTA_DAILY_BYTES: %w", err)
+		}
+	}
+	if msgs > 0 || bytes > 0 {
+		l.quota = &dailyQuota{maxMsgs: msgs, maxBytes: bytes}
+	}
+	return l, nil
+}
+
+// admit applies the publish limits to one message of size bytes from p at ip.
+// The client's own limits are checked before the channel's shared bucket, so
+// a refused client cannot drain it for everyone else. Without auth the quota
+// is kept per IP.
+func (s *Server) admit(p *principal, ip, channel string, size int) error {
+	now := time.Now()
+	id := p.identity()
+	lim := s.limits.Load()
+	if id != "" {
+		if ok, wait := lim.identity.take(id, now); !ok {
+			return &limitError{"rate limit exceeded for token", wait}
+		}
+	}
+	if ok, wait := lim.ip.take(ip, now); !ok {
+		return &limitError{"rate limit exceeded for client", wait}
+	}
+	if ok, wait := lim.channel.take(channel, now); !ok {
+		return &limitError{"rate limit exceeded for channel", wait}
+	}
+	if id == "" {
+		id = "ip:" + ip
+	}
+	if ok, wait := lim.quota.charge(id, size, now); !ok {
+		lim.channel.refund(channel)
+		return &limitError{"daily quota exceeded", wait}
+	}
+	return nil
+}
+
+// clientIP is the request's address as set by the RealIP middleware, without port.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
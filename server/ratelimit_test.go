@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := []struct {
+		in          string
+		rate, burst float64
+		wantErr     bool
+	}{
+		{in: "100/s", rate: 100, burst: 100},
+		{in: "60/m", rate: 1, burst: 60},
+		{in: "3600/h:10", rate: 1, burst: 10},
+		{in: "0.5/s", rate: 0.5, burst: 1},
+		{in: "0.5/m", rate: 0.5 / 60, burst: 1},
+		{in: "10/s:0", wantErr: true},
+		{in: "0/s", wantErr: true},
+		{in: "-1/s", wantErr: true},
+		{in: "100", wantErr: true},
+		{in: "100/d", wantErr: true},
+		{in: "x/s", wantErr: true},
+		{in: "10/s:x", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tc := range cases {
+		rate, burst, err := parseRate(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseRate(%q) error = %v, wantErr %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && (rate != tc.rate || burst != tc.burst) {
+			t.Errorf("parseRate(%q) = %v, %v; want %v, %v", tc.in, rate, burst, tc.rate, tc.burst)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(1, 2)
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if ok, _ := tb.take("k", now); ok != want {
+			t.Fatalf("take %d = %v, want %v", i, ok, want)
+		}
+	}
+	if ok, wait := tb.take("k", now); ok || wait <= 0 || wait > time.Second {
+		t.Fatalf("over limit: ok=%v wait=%v", ok, wait)
+	}
+	if ok, _ := tb.take("other", now); !ok {
+		t.Fatal("buckets are not per key")
+	}
+	if ok, _ := tb.take("k", now.Add(time.Second)); !ok {
+		t.Fatal("bucket did not refill")
+	}
+}
+
+func TestFractionalRateAdmits(t *testing.T) {
+	rate, burst, err := parseRate("0.2/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := newTokenBucket(rate, burst)
+	now := time.Now()
+	admitted := 0
+	for i := 0; i < 100; i++ {
+		if ok, _ := tb.take("k", now.Add(time.Duration(i)*time.Second)); ok {
+			admitted++
+		}
+	}
+	if admitted != 20 {
+		t.Fatalf("admitted %d of 100 messages over 100s at 0.2/s, want 20", admitted)
+	}
+}
+
+func TestAdmitSparesChannelBucket(t *testing.T) {
+	s := &Server{}
+	s.limits.Store(&limits{
+		ip:      newTokenBucket(1.0/3600, 1),
+		channel: newTokenBucket(1.0/3600, 2),
+		quota:   &dailyQuota{maxMsgs: 1},
+	})
+	open := &principal{open: true}
+	if err := s.admit(open, "10.0.0.1", "/c", 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := s.admit(open, "10.0.0.1", "/c", 1); err == nil {
+			t.Fatal("client over its IP limit was admitted")
+		}
+	}
+	// over quota but under its IP limit: refused, with the channel token refunded
+	s.limits.Load().quota.charge("ip:10.0.0.2", 1, time.Now())
+	if err := s.admit(open, "10.0.0.2", "/c", 1); err == nil {
+		t.Fatal("client over its quota was admitted")
+	}
+	if err := s.admit(open, "10.0.0.3", "/c", 1); err != nil {
+		t.Fatalf("channel bucket drained by refused clients: %v", err)
+	}
+}
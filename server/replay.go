@@ -0,0 +1,234 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// envelopeMeta is the subset of _meta the server needs for ordering and lookups.
+type envelopeMeta struct {
+	ID           string `json:"id"`
+	TS           string `json:"ts"`
+	UnixNs       int64  `json:"unixNs"`
+	OriginNodeID string `json:"originNodeId"`
+	Channel      string `json:"channel"`
+	KeyVersion   int    `json:"keyVersion"`
+	HMAC         string `json:"hmac"`
+}
+
+func parseMeta(env []byte) (envelopeMeta, bool) {
+	var v struct {
+		Meta *envelopeMeta `json:"_meta"`
+	}
+	if err := json.Unmarshal(env, &v); err != nil || v.Meta == nil {
+		return envelopeMeta{}, false
+	}
+	return *v.Meta, true
+}
+
+type replayEntry struct {
+	id     string
+	unixNs int64
+	at     time.Time
+	msg    []byte
+}
+
+// replayRing keeps the most recent envelopes of a channel, bounded by count and age.
+type replayRing struct {
+	mu     sync.Mutex
+	max    int
+	maxAge time.Duration
+	buf    []replayEntry
+	start  int
+	n      int
+}
+
+func newReplayRing(max int, maxAge time.Duration) *replayRing {
+	if max <= 0 {
+		return nil
+	}
+	return &replayRing{max: max, maxAge: maxAge, buf: make([]replayEntry, max)}
+}
+
+func (r *replayRing) push(msg []byte) {
+	if r == nil {
+		return
+	}
+	e := replayEntry{at: time.Now(), msg: msg}
+	if m, ok := parseMeta(msg); ok {
+		e.id, e.unixNs = m.ID, m.UnixNs
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.n < r.max {
+		r.buf[(r.start+r.n)%r.max] = e
+		r.n++
+		return
+	}
+	r.buf[r.start] = e
+	r.start = (r.start + 1) % r.max
+}
+
+// empty reports whether the ring holds nothing a subscriber could still replay.
+func (r *replayRing) empty() bool {
+	if r == nil {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.n == 0 {
+		return true
+	}
+	newest := r.buf[(r.start+r.n-1)%r.max]
+	return r.maxAge > 0 && time.Since(newest.at) > r.maxAge
+}
+
+// replayQuery selects what a new subscriber receives before going live.
+type replayQuery struct {
+	sinceID string
+	sinceNs int64
+	last    int // <0 means unlimited
+}
+
+// parseReplayQuery reads ?since=<_meta.id|RFC3339> and ?last=N.
+func parseReplayQuery(since, last string) replayQuery {
+	q := replayQuery{last: -1}
+	if since != "" {
+		if t, err := time.Parse(time.RFC3339Nano, since); err == nil {
+			q.sinceNs = t.UnixNano()
+		} else {
+			q.sinceID = since
+		}
+	}
+	if last != "" {
+		if n, err := strconv.Atoi(last); err == nil && n >= 0 {
+			q.last = n
+		}
+	}
+	return q
+}
+
+// snapshot returns the buffered envelopes matching q, oldest first.
+func (r *replayRing) snapshot(q replayQuery) [][]byte {
+	if r == nil || q.last == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var cutoff time.Time
+	if r.maxAge > 0 {
+		cutoff = time.Now().Add(-r.maxAge)
+	}
+	out := make([][]byte, 0, r.n)
+	for i := 0; i < r.n; i++ {
+		e := r.buf[(r.start+i)%r.max]
+		if !cutoff.IsZero() && e.at.Before(cutoff) {
+			continue
+		}
+		// UUIDv7 strings sort by creation time
+		if q.sinceID != "" && e.id <= q.sinceID {
+			continue
+		}
+		if q.sinceNs != 0 && e.unixNs <= q.sinceNs {
+			continue
+		}
+		out = append(out, e.msg)
+	}
+	if q.last > 0 && len(out) > q.last {
+		out = out[len(out)-q.last:]
+	}
+	return out
+}
+
+// entries returns the buffered entries that have not aged out, oldest first.
+func (r *replayRing) entries() []replayEntry {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var cutoff time.Time
+	if r.maxAge > 0 {
+		cutoff = time.Now().Add(-r.maxAge)
+	}
+	out := make([]replayEntry, 0, r.n)
+	for i := 0; i < r.n; i++ {
+		e := r.buf[(r.start+i)%r.max]
+		if cutoff.IsZero() || !e.at.Before(cutoff) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// mergeRings returns a ring with the newest max entries of srcs ordered by
+// _meta.unixNs. Entries keep their arrival time, so they age out when they
+// would have in their source ring, and an id buffered twice is kept once.
+func mergeRings(max int, maxAge time.Duration, srcs []*replayRing) *replayRing {
+	out := newReplayRing(max, maxAge)
+	if out == nil {
+		return nil
+	}
+	var runs [][]replayEntry
+	for _, src := range srcs {
+		es := src.entries()
+		if len(es) == 0 {
+			continue
+		}
+		// peers may deliver slightly out of order; each run must be sorted for the merge
+		if !sort.SliceIsSorted(es, func(i, j int) bool { return es[i].unixNs < es[j].unixNs }) {
+			sort.SliceStable(es, func(i, j int) bool { return es[i].unixNs < es[j].unixNs })
+		}
+		runs = append(runs, es)
+	}
+	// walk the runs from their newest ends, taking at most max entries
+	h := make(runHeap, 0, len(runs))
+	for _, es := range runs {
+		h = append(h, es)
+	}
+	heap.Init(&h)
+	newest := make([]replayEntry, 0, max)
+	seen := make(map[string]bool, max)
+	for h.Len() > 0 && len(newest) < max {
+		es := h[0]
+		e := es[len(es)-1]
+		if es = es[:len(es)-1]; len(es) == 0 {
+			heap.Pop(&h)
+		} else {
+			h[0] = es
+			heap.Fix(&h, 0)
+		}
+		if e.id != "" {
+			if seen[e.id] {
+				continue
+			}
+			seen[e.id] = true
+		}
+		newest = append(newest, e)
+	}
+	for i := len(newest) - 1; i >= 0; i-- {
+		out.buf[out.n] = newest[i]
+		out.n++
+	}
+	return out
+}
+
+// runHeap orders sorted entry runs by their newest entry, newest on top.
+type runHeap [][]replayEntry
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	return h[i][len(h[i])-1].unixNs > h[j][len(h[j])-1].unixNs
+}
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)   { *h = append(*h, x.([]replayEntry)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplayRing(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	env := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"_meta":{"id":"id-%02d","unixNs":%d}}`, i, base.Add(time.Duration(i)*time.Second).UnixNano()))
+	}
+	r := newReplayRing(5, time.Hour)
+	for i := 1; i <= 8; i++ {
+		r.push(env(i))
+	}
+	ids := func(q replayQuery) string {
+		var out []string
+		for _, msg := range r.snapshot(q) {
+			m, _ := parseMeta(msg)
+			out = append(out, m.ID)
+		}
+		return fmt.Sprint(out)
+	}
+	cases := []struct {
+		name, since, last string
+		want              string
+	}{
+		{"everything after wrap-around", "", "", "[id-04 id-05 id-06 id-07 id-08]"},
+		{"last", "", "2", "[id-07 id-08]"},
+		{"last beyond size", "", "50", "[id-04 id-05 id-06 id-07 id-08]"},
+		{"last=0", "", "0", "[]"},
+		{"invalid last is ignored", "", "-1", "[id-04 id-05 id-06 id-07 id-08]"},
+		{"since id", "id-05", "", "[id-06 id-07 id-08]"},
+		{"since evicted id", "id-01", "", "[id-04 id-05 id-06 id-07 id-08]"},
+		{"since newest id", "id-08", "", "[]"},
+		{"since time", base.Add(6 * time.Second).Format(time.RFC3339Nano), "", "[id-07 id-08]"},
+		{"since time and last", base.Add(4 * time.Second).Format(time.RFC3339), "1", "[id-08]"},
+	}
+	for _, tc := range cases {
+		if got := ids(parseReplayQuery(tc.since, tc.last)); got != tc.want {
+			t.Errorf("%s: since=%q last=%q replayed %s, want %s", tc.name, tc.since, tc.last, got, tc.want)
+		}
+	}
+
+	// entries older than maxAge are not replayed, and a ring of only those is empty
+	for i := 0; i < 3; i++ {
+		r.buf[(r.start+i)%r.max].at = time.Now().Add(-2 * time.Hour)
+	}
+	if got := ids(replayQuery{last: -1}); got != "[id-07 id-08]" {
+		t.Errorf("after aging out the oldest three replayed %s, want [id-07 id-08]", got)
+	}
+	if r.empty() {
+		t.Error("ring with live entries reported empty")
+	}
+	for i := 0; i < r.n; i++ {
+		r.buf[i].at = time.Now().Add(-2 * time.Hour)
+	}
+	if !r.empty() {
+		t.Error("ring of expired entries not empty")
+	}
+
+	if newReplayRing(0, time.Hour) != nil {
+		t.Error("REPLAY_MAX=0 created a ring")
+	}
+	var off *replayRing
+	off.push(env(1))
+	if off.snapshot(replayQuery{last: -1}) != nil || !off.empty() {
+		t.Error("disabled ring replays")
+	}
+}
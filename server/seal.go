@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// payloadKDFLabel separates the payload encryption key from the HMAC key
+// derived from the same cluster key version.
+const payloadKDFLabel = "loghud-payload-v1"
+
+var errSealedFrame = errors.New("cannot decrypt payload")
+
+func payloadAEAD(key []byte) (cipher.AEAD, error) {
+	k := sha256.Sum256(append(append([]byte{}, key...), payloadKDFLabel...))
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealFrame encrypts f.Data with AES-256-GCM under the active cluster key.
+// The channel and id are authenticated so a frame cannot be replayed elsewhere.
+func (s *Server) sealFrame(f *clusterFrame) error {
+	ver, key := s.keys.signing()
+	aead, err := payloadAEAD(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	f.Sealed = append(nonce, aead.Seal(nil, nonce, f.Data, frameAD(f))...)
+	f.KeyVersion = ver
+	f.Data = nil
+	return nil
+}
+
+// openFrame reverses sealFrame, leaving the plaintext envelope in f.Data.
+func (s *Server) openFrame(f *clusterFrame) error {
+	key := s.keys.lookup(f.KeyVersion)
+	if key == nil {
+		return errSealedFrame
+	}
+	aead, err := payloadAEAD(key)
+	if err != nil {
+		return err
+	}
+	n := aead.NonceSize()
+	if len(f.Sealed) < n {
+		return errSealedFrame
+	}
+	data, err := aead.Open(nil, f.Sealed[:n], f.Sealed[n:], frameAD(f))
+	if err != nil {
+		return errSealedFrame
+	}
+	f.Data, f.Sealed = data, nil
+	return nil
+}
+
+func frameAD(f *clusterFrame) []byte {
+	return []byte(f.Channel + "\x00" + f.ID)
+}
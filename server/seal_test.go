@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSealFrame(t *testing.T) {
+	s := &Server{keys: newKeyring(1, []byte("k1"))}
+	env := json.RawMessage(`{"message":"secret","_meta":{"id":"a"}}`)
+	sealed := func() clusterFrame {
+		f := clusterFrame{Type: "Msg", ID: "a", Channel: "/logs/app", Data: env}
+		if err := s.sealFrame(&f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Data != nil || f.KeyVersion != 1 || bytes.Contains(f.Sealed, []byte("secret")) {
+			t.Fatalf("sealed frame leaks its payload: %+v", f)
+		}
+		return f
+	}
+
+	f := sealed()
+	// a round trip through the wire format
+	raw, _ := json.Marshal(f)
+	var got clusterFrame
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.openFrame(&got); err != nil || !bytes.Equal(got.Data, env) || got.Sealed != nil {
+		t.Fatalf("openFrame = %s, %v; want %s", got.Data, err, env)
+	}
+
+	tamper := []func(*clusterFrame){
+		func(f *clusterFrame) { f.Channel = "/logs/other" },
+		func(f *clusterFrame) { f.ID = "b" },
+		func(f *clusterFrame) { f.Sealed[len(f.Sealed)-1] ^= 1 },
+		func(f *clusterFrame) { f.Sealed = f.Sealed[:4] },
+		func(f *clusterFrame) { f.KeyVersion = 2 },
+	}
+	for i, mod := range tamper {
+		f := sealed()
+		mod(&f)
+		if err := s.openFrame(&f); err != errSealedFrame {
+			t.Errorf("tampered frame %d opened: %v", i, err)
+		}
+	}
+
+	// frames sealed under a retired key open until it expires
+	f = sealed()
+	v2, _ := s.keys.rotate()
+	s.keys.activate(v2, time.Hour)
+	if err := s.openFrame(&f); err != nil {
+		t.Fatalf("frame under retired key: %v", err)
+	}
+	f = clusterFrame{Type: "Msg", ID: "a", Channel: "/logs/app", Data: env}
+	_ = s.sealFrame(&f)
+	if f.KeyVersion != v2 {
+		t.Fatalf("sealed with version %d, want active %d", f.KeyVersion, v2)
+	}
+	other := &Server{keys: newKeyring(v2, []byte("other"))}
+	if err := other.openFrame(&f); err != errSealedFrame {
+		t.Fatalf("frame opened under another cluster key: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+const (
+	// drainPoll is how often shutdown checks whether queues have emptied
+	drainPoll = 50 * time.Millisecond
+	// closeWait bounds how long shutdown waits for clients to answer the close frame
+	closeWait = 2 * time.Second
+)
+
+// shutdown stops srv from accepting connections, lets in-flight requests
+// finish, drains hub queues and peer forwards until ctx is done, then closes
+// every subscriber with StatusGoingAway and a reconnect hint.
+func (s *Server) shutdown(ctx context.Context, srv *http.Server) {
+	// hijacked WebSockets are not waited for; they are closed below
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("shutdown: http:", err)
+	}
+	if !waitFor(ctx, s.hubsDrained) {
+		log.Println("shutdown: hub queues not drained before the deadline")
+	}
+	if !waitFor(ctx, s.peersDrained) {
+		log.Println("shutdown: peer forwards not drained before the deadline")
+	}
+	n := s.closeSubscribers()
+	log.Printf("shutdown: closed %d subscribers", n)
+	if s.store != nil {
+		s.store.Close()
+	}
+}
+
+// waitFor polls done until it reports true or ctx ends.
+func waitFor(ctx context.Context, done func() bool) bool {
+	t := time.NewTicker(drainPoll)
+	defer t.Stop()
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return done()
+		case <-t.C:
+		}
+	}
+	return true
+}
+
+func (s *Server) liveHubs() []*Hub {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]*Hub, 0, len(s.hubs))
+	for _, h := range s.hubs {
+		out = append(out, h)
+	}
+	return out
+}
+
+func (s *Server) hubsDrained() bool {
+	for _, h := range s.liveHubs() {
+		if !h.drained() {
+			return false
+		}
+	}
+	return true
+}
+
+// drained reports whether nothing is waiting in the hub or client queues.
+func (h *Hub) drained() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.in) > 0 {
+		return false
+	}
+	for _, c := range h.clients {
+		if len(c.send) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// peersDrained reports whether every connected peer has acked what it was sent.
+// A disconnected peer cannot drain and is not waited for.
+func (s *Server) peersDrained() bool {
+	for _, l := range s.peerLinks() {
+		if st := l.stats(); st.Connected && st.Queued+st.Inflight > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// closeSubscribers sends StatusGoingAway to every subscriber socket once,
+// with a jittered reconnect delay so clients do not return in lockstep.
+func (s *Server) closeSubscribers() int {
+	seen := make(map[*websocket.Conn]bool)
+	for _, h := range s.liveHubs() {
+		h.mu.RLock()
+		for conn := range h.clients {
+			seen[conn] = true
+		}
+		h.mu.RUnlock()
+	}
+	var wg sync.WaitGroup
+	for conn := range seen {
+		hint, _ := json.Marshal(map[string]any{"reason": "shutdown", "reconnectAfterMs": 1000 + rand.Intn(4000)})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = conn.Close(websocket.StatusGoingAway, string(hint))
+		}()
+	}
+	// Close waits for the client's reply; don't let a dead client hold up exit
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(closeWait):
+	}
+	return len(seen)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestHubsDrained(t *testing.T) {
+	s := &Server{hubs: make(map[string]*Hub)}
+	h := NewHub(0, 0)
+	s.hubs["/c"] = h
+	if !s.hubsDrained() {
+		t.Fatal("idle hub not drained")
+	}
+	h.in <- hubMsg{data: []byte(`{}`)}
+	if s.hubsDrained() {
+		t.Fatal("hub with a queued message reported drained")
+	}
+	<-h.in
+	conn := &websocket.Conn{}
+	c := &client{conn: conn, send: make(chan outMsg, 1), done: make(chan struct{})}
+	c.send <- outMsg{data: []byte(`{}`)}
+	h.clients[conn] = c
+	if s.hubsDrained() {
+		t.Fatal("hub with a queued client message reported drained")
+	}
+	<-c.send
+	if !s.hubsDrained() {
+		t.Fatal("emptied hub not drained")
+	}
+}
+
+func TestPeersDrained(t *testing.T) {
+	s := &Server{links: make(map[string]*peerLink)}
+	l := newPeerLink(s, "http://peer")
+	s.links[l.base] = l
+	l.setConnected(true, nil)
+	if !s.peersDrained() {
+		t.Fatal("idle peer not drained")
+	}
+	l.enqueue(clusterFrame{Type: "Msg", ID: "1"})
+	if s.peersDrained() {
+		t.Fatal("peer with a queued frame reported drained")
+	}
+	<-l.queue
+	l.inflight["1"] = clusterFrame{Type: "Msg", ID: "1"}
+	if s.peersDrained() {
+		t.Fatal("peer with an unacked frame reported drained")
+	}
+	// a disconnected peer cannot ack and is not waited for
+	l.setConnected(false, errors.New("gone"))
+	if !s.peersDrained() {
+		t.Fatal("disconnected peer held up shutdown")
+	}
+	l.setConnected(true, nil)
+	l.nextResend()
+	l.ack(clusterFrame{Type: "Ack", ID: "1"})
+	if !s.peersDrained() {
+		t.Fatal("acked peer not drained")
+	}
+}
+
+func TestCloseSubscribers(t *testing.T) {
+	s := &Server{}
+	base := newSocketServer(t, s)
+	ch := dialSocket(t, base+"/logs/app", "")
+	mux := dialSocket(t, base+"/_ws", "")
+	for _, c := range []string{"/logs/app", "/logs/**"} {
+		if rep, _ := mux.call(muxFrame{Op: "subscribe", Channel: c}); rep.Op != "ack" {
+			t.Fatalf("subscribe %s = %+v", c, rep)
+		}
+	}
+	// the channel socket is registered once its welcome notice arrives
+	ch.read()
+
+	closed := make(chan int, 1)
+	go func() { closed <- s.closeSubscribers() }()
+	for name, ws := range map[string]*testSocket{"channel": ch, "mux": mux} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		var err error
+		for err == nil {
+			_, _, err = ws.c.Read(ctx)
+		}
+		cancel()
+		var ce websocket.CloseError
+		if !errors.As(err, &ce) || ce.Code != websocket.StatusGoingAway {
+			t.Fatalf("%s socket closed with %v, want StatusGoingAway", name, err)
+		}
+		var hint struct {
+			Reason           string `json:"reason"`
+			ReconnectAfterMs int    `json:"reconnectAfterMs"`
+		}
+		if err := json.Unmarshal([]byte(ce.Reason), &hint); err != nil || hint.Reason != "shutdown" || hint.ReconnectAfterMs < 1000 || hint.ReconnectAfterMs >= 5000 {
+			t.Fatalf("%s close reason %q, want a shutdown hint with a 1-5s delay", name, ce.Reason)
+		}
+	}
+	// the mux socket follows two hubs but is closed once
+	if n := <-closed; n != 2 {
+		t.Fatalf("closed %d subscribers, want 2", n)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// reply reads past delivered envelopes to the next ack or error.
+func (s *testSocket) reply() muxIn {
+	s.t.Helper()
+	for {
+		if in := s.read(); in.Op != "" {
+			return in
+		}
+	}
+}
+
+func TestChannelSocketPublish(t *testing.T) {
+	s := &Server{}
+	s.auth.Store(&authConfig{static: map[string]*principal{
+		"rw": {Perms: []string{permPublish, permSubscribe}},
+		"ro": {Perms: []string{permSubscribe}},
+	}})
+	s.limits.Store(&limits{channel: newTokenBucket(1.0/3600, 2)})
+	base := newSocketServer(t, s)
+
+	ws := dialSocket(t, base+"/logs/app?ack=1", "rw")
+	ws.write([]byte(`{"message":`))
+	if rep := ws.reply(); rep.Op != "error" || rep.Error != "invalid json" || rep.Channel != "/logs/app" {
+		t.Fatalf("invalid publish = %+v", rep)
+	}
+	ws.write([]byte(`{"message":"one"}`))
+	if rep := ws.reply(); rep.Op != "ack" || rep.MsgID == "" || rep.Channel != "/logs/app" {
+		t.Fatalf("publish = %+v", rep)
+	}
+	ws.write([]byte(`{"message":"two"}`))
+	if rep := ws.reply(); rep.Op != "error" || rep.Error != "rate limit exceeded for channel" {
+		t.Fatalf("publish over the channel rate = %+v", rep)
+	}
+
+	ro := dialSocket(t, base+"/logs/ro?ack=true", "ro")
+	ro.write([]byte(`{"message":"hi"}`))
+	if rep := ro.reply(); rep.Op != "error" || rep.Error != "publish not allowed" {
+		t.Fatalf("publish without permission = %+v", rep)
+	}
+
+	// without ?ack the publisher only sees its message delivered
+	quiet := dialSocket(t, base+"/logs/quiet", "rw")
+	quiet.write([]byte(`{"message":"hush"}`))
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, b, err := quiet.c.Read(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var f struct {
+			Op      string `json:"op"`
+			Message string `json:"message"`
+			System  bool   `json:"system"`
+		}
+		_ = json.Unmarshal(b, &f)
+		if f.Op != "" {
+			t.Fatalf("reply %s without ?ack", b)
+		}
+		if !f.System {
+			if f.Message != "hush" {
+				t.Fatalf("delivered %s, want hush", b)
+			}
+			break
+		}
+	}
+}
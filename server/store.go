@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const segmentExt = ".ndjson"
+
+// retentionPolicy bounds what the store keeps for channels matching pattern.
+// Zero values mean unlimited.
+type retentionPolicy struct {
+	pattern  string
+	maxBytes int64
+	maxAge   time.Duration
+}
+
+// Store is an append-only channel log: one directory per channel holding
+// NDJSON segments named after the local time they were opened. A closed
+// segment's name also records the lowest and highest _meta.unixNs in it,
+// "<opened>_<min>_<max>.ndjson", so queries can skip it without reading it.
+type Store struct {
+	dir      string
+	segBytes int64
+	segAge   time.Duration
+	policies []retentionPolicy
+	fallback retentionPolicy
+
+	mu    sync.Mutex
+	chans map[string]*channelLog
+}
+
+type channelLog struct {
+	mu       sync.Mutex
+	dir      string
+	f        *os.File
+	name     string
+	opened   time.Time
+	size     int64
+	lastSeen time.Time
+	// unixNs bounds of the envelopes in the open segment
+	entries      int
+	minNs, maxNs int64
+	// removed is set once cleanup deleted the directory and dropped the entry
+	removed bool
+}
+
+func OpenStore(dir string, segBytes int64, segAge time.Duration, fallback retentionPolicy, policies []retentionPolicy) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create store dir: %w", err)
+	}
+	return &Store{
+		dir:      dir,
+		segBytes: segBytes,
+		segAge:   segAge,
+		policies: policies,
+		fallback: fallback,
+		chans:    make(map[string]*channelLog),
+	}, nil
+}
+
+func (st *Store) channelDir(channel string) string {
+	return filepath.Join(st.dir, url.PathEscape(channel))
+}
+
+func (st *Store) logFor(channel string) *channelLog {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	cl, ok := st.chans[channel]
+	if !ok {
+		cl = &channelLog{dir: st.channelDir(channel)}
+		st.chans[channel] = cl
+	}
+	return cl
+}
+
+// lockedLogFor returns channel's log with its lock held, skipping one that
+// cleanup removed after the lookup.
+func (st *Store) lockedLogFor(channel string) *channelLog {
+	for {
+		cl := st.logFor(channel)
+		cl.mu.Lock()
+		if !cl.removed {
+			return cl
+		}
+		cl.mu.Unlock()
+	}
+}
+
+// forget drops channel's entry if it is still cl, which cleanup removed.
+func (st *Store) forget(channel string, cl *channelLog) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.chans[channel] == cl {
+		delete(st.chans, channel)
+	}
+}
+
+// Append writes one envelope as a line to the channel's active segment.
+func (st *Store) Append(channel string, env []byte, unixNs int64) error {
+	cl := st.lockedLogFor(channel)
+	defer cl.mu.Unlock()
+	now := time.Now()
+	if cl.f == nil || (st.segBytes > 0 && cl.size >= st.segBytes) || (st.segAge > 0 && now.Sub(cl.opened) >= st.segAge) {
+		if err := cl.rotate(now); err != nil {
+			return err
+		}
+	}
+	line := make([]byte, 0, len(env)+1)
+	line = append(append(line, env...), '\n')
+	n, err := cl.f.Write(line)
+	cl.size += int64(n)
+	cl.lastSeen = now
+	if cl.entries == 0 || unixNs < cl.minNs {
+		cl.minNs = unixNs
+	}
+	if cl.entries == 0 || unixNs > cl.maxNs {
+		cl.maxNs = unixNs
+	}
+	cl.entries++
+	return err
+}
+
+func (cl *channelLog) rotate(now time.Time) error {
+	cl.seal()
+	if err := os.MkdirAll(cl.dir, 0o755); err != nil {
+		return err
+	}
+	// a fresh file per segment, so the recorded bounds cover all of it
+	for start := now.UnixNano(); ; start++ {
+		name := fmt.Sprintf("%020d%s", start, segmentExt)
+		f, err := os.OpenFile(filepath.Join(cl.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		cl.f, cl.name, cl.opened, cl.size = f, name, now, 0
+		cl.entries, cl.minNs, cl.maxNs = 0, 0, 0
+		return nil
+	}
+}
+
+// seal closes the open segment and renames it to record its unixNs bounds.
+func (cl *channelLog) seal() {
+	if cl.f == nil {
+		return
+	}
+	_ = cl.f.Close()
+	if cl.entries > 0 {
+		start := strings.TrimSuffix(cl.name, segmentExt)
+		if err := os.Rename(filepath.Join(cl.dir, cl.name), filepath.Join(cl.dir, sealedName(start, cl.minNs, cl.maxNs))); err != nil {
+			log.Println("store seal:", err)
+		}
+	}
+	cl.f, cl.name = nil, ""
+}
+
+func sealedName(start string, minNs, maxNs int64) string {
+	return fmt.Sprintf("%s_%d_%d%s", start, minNs, maxNs, segmentExt)
+}
+
+// sealLeftover records the bounds of a segment left open by an earlier
+// process, reading it once.
+func sealLeftover(dir string, seg *segmentInfo) error {
+	n := 0
+	err := scanSegment(filepath.Join(dir, seg.name), func(e storedEnvelope) {
+		if n == 0 || e.unixNs < seg.minNs {
+			seg.minNs = e.unixNs
+		}
+		if n == 0 || e.unixNs > seg.maxNs {
+			seg.maxNs = e.unixNs
+		}
+		n++
+	})
+	if err == errSegmentGone || n == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	name := sealedName(fmt.Sprintf("%020d", seg.startNs), seg.minNs, seg.maxNs)
+	if err := os.Rename(filepath.Join(dir, seg.name), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	seg.name, seg.sealed = name, true
+	return nil
+}
+
+func (st *Store) policyFor(channel string) retentionPolicy {
+	for _, p := range st.policies {
+		if matchChannel(p.pattern, channel) {
+			return p
+		}
+	}
+	return st.fallback
+}
+
+// Run applies retention every interval until ctx is done.
+func (st *Store) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			st.cleanup()
+		}
+	}
+}
+
+func (st *Store) cleanup() {
+	entries, err := os.ReadDir(st.dir)
+	if err != nil {
+		log.Println("store cleanup:", err)
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		channel, err := url.PathUnescape(e.Name())
+		if err != nil {
+			continue
+		}
+		st.cleanupChannel(channel)
+	}
+}
+
+func (st *Store) cleanupChannel(channel string) {
+	pol := st.policyFor(channel)
+	cl := st.lockedLogFor(channel)
+	defer cl.mu.Unlock()
+	// release handles of channels that went quiet; the next Append opens a fresh segment
+	if cl.f != nil && time.Since(cl.lastSeen) > time.Minute {
+		cl.seal()
+	}
+	segs, err := listSegments(cl.dir)
+	if err != nil {
+		if os.IsNotExist(err) && cl.f == nil {
+			cl.removed = true
+			st.forget(channel, cl)
+		}
+		return
+	}
+	var total int64
+	for i := range segs {
+		if !segs[i].sealed && segs[i].name != cl.name {
+			if err := sealLeftover(cl.dir, &segs[i]); err != nil {
+				log.Println("store seal:", err)
+			}
+		}
+		total += segs[i].size
+	}
+	cutoff := time.Time{}
+	if pol.maxAge > 0 {
+		cutoff = time.Now().Add(-pol.maxAge)
+	}
+	for _, s := range segs {
+		if s.name == cl.name {
+			break
+		}
+		expired := !cutoff.IsZero() && s.modTime.Before(cutoff)
+		oversize := pol.maxBytes > 0 && total > pol.maxBytes
+		if !expired && !oversize {
+			break
+		}
+		if err := os.Remove(filepath.Join(cl.dir, s.name)); err != nil {
+			log.Println("store remove:", err)
+			continue
+		}
+		total -= s.size
+	}
+	if cl.f == nil {
+		// drops the directory only when no segments are left; an Append
+		// waiting on cl sees removed and starts over with a fresh entry
+		if err := os.Remove(cl.dir); err == nil || os.IsNotExist(err) {
+			cl.removed = true
+			st.forget(channel, cl)
+		}
+	}
+}
+
+type segmentInfo struct {
+	name    string
+	startNs int64 // local time the segment was opened
+	// sealed segments hold envelopes with unixNs in [minNs, maxNs]; the
+	// open one, or one left open by a crash, may hold any
+	sealed       bool
+	minNs, maxNs int64
+	size         int64
+	modTime      time.Time
+}
+
+// listSegments returns a channel directory's segments, oldest first.
+func listSegments(dir string) ([]segmentInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []segmentInfo
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seg, ok := parseSegmentName(name)
+		if !ok {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		seg.size, seg.modTime = fi.Size(), fi.ModTime()
+		segs = append(segs, seg)
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].startNs < segs[j].startNs })
+	return segs, nil
+}
+
+// parseSegmentName reads "<start>.ndjson" or "<start>_<min>_<max>.ndjson".
+func parseSegmentName(name string) (segmentInfo, bool) {
+	f := strings.Split(strings.TrimSuffix(name, segmentExt), "_")
+	if len(f) != 1 && len(f) != 3 {
+		return segmentInfo{}, false
+	}
+	var ns [3]int64
+	for i, v := range f {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return segmentInfo{}, false
+		}
+		ns[i] = n
+	}
+	return segmentInfo{name: name, startNs: ns[0], sealed: len(f) == 3, minNs: ns[1], maxNs: ns[2]}, true
+}
+
+func (st *Store) Close() {
+	// cleanup holds a log's lock while it takes st.mu, so never nest the other way
+	st.mu.Lock()
+	logs := make([]*channelLog, 0, len(st.chans))
+	for _, cl := range st.chans {
+		logs = append(logs, cl)
+	}
+	st.mu.Unlock()
+	for _, cl := range logs {
+		cl.mu.Lock()
+		cl.seal()
+		cl.mu.Unlock()
+	}
+}
+
+// parseRetention reads "pattern:maxBytes:maxAge" entries separated by commas,
+// e.g. "/debug/**:16MB:1h,/logs/*:512MB:72h". Empty fields mean unlimited.
+func parseRetention(v string) ([]retentionPolicy, error) {
+	var out []retentionPolicy
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		f := strings.Split(part, ":")
+		if len(f) != 3 {
+			return nil, fmt.Errorf("retention %q: want pattern:maxBytes:maxAge", part)
+		}
+		p := retentionPolicy{pattern: "/" + strings.TrimPrefix(f[0], "/")}
+		var err error
+		if p.maxBytes, err = parseSize(f[1]); err != nil {
+			return nil, fmt.Errorf("retention %q: %w", part, err)
+		}
+		if f[2] != "" {
+			if p.maxAge, err = time.ParseDuration(f[2]); err != nil {
+				return nil, fmt.Errorf("retention %q: %w", part, err)
+			}
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// parseSize accepts plain bytes or a KB/MB/GB suffix (powers of 1024).
+func parseSize(v string) (int64, error) {
+	v = strings.ToUpper(strings.TrimSpace(v))
+	if v == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(v, u.suffix) {
+			v, mult = strings.TrimSuffix(v, u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return n * mult, nil
+}
+
+// storeFromEnv opens the store at dir using STORE_SEGMENT_BYTES, STORE_SEGMENT_AGE,
+// STORE_MAX_BYTES, STORE_MAX_AGE and per-pattern STORE_RETENTION overrides.
+func storeFromEnv(dir string) (*Store, error) {
+	segBytes, err := parseSize(envOr("STORE_SEGMENT_BYTES", "8MB"))
+	if err != nil {
+		return nil, err
+	}
+	segAge, err := time.ParseDuration(envOr("STORE_SEGMENT_AGE", "1h"))
+	if err != nil {
+		return nil, fmt.Errorf("STORE_SEGMENT_AGE: %w", err)
+	}
+	fallback := retentionPolicy{pattern: "/**"}
+	if fallback.maxBytes, err = parseSize(envOr("STORE_MAX_BYTES", "256MB")); err != nil {
+		return nil, err
+	}
+	if fallback.maxAge, err = time.ParseDuration(envOr("STORE_MAX_AGE", "168h")); err != nil {
+		return nil, fmt.Errorf("STORE_MAX_AGE: %w", err)
+	}
+	policies, err := parseRetention(os.Getenv("STORE_RETENTION"))
+	if err != nil {
+		return nil, err
+	}
+	return OpenStore(dir, segBytes, segAge, fallback, policies)
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "512", want: 512},
+		{in: "512B", want: 512},
+		{in: "16kb", want: 16 << 10},
+		{in: " 8MB ", want: 8 << 20},
+		{in: "2GB", want: 2 << 30},
+		{in: "1.5MB", wantErr: true},
+		{in: "MB", wantErr: true},
+		{in: "1TB", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := parseSize(tc.in)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d, wantErr %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    []retentionPolicy
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "/debug/**:16MB:1h", want: []retentionPolicy{{"/debug/**", 16 << 20, time.Hour}}},
+		{in: "logs/*:512MB:, /audit/**::8760h", want: []retentionPolicy{
+			{"/logs/*", 512 << 20, 0},
+			{"/audit/**", 0, 8760 * time.Hour},
+		}},
+		{in: "/x:1MB", wantErr: true},
+		{in: "/x:lots:1h", wantErr: true},
+		{in: "/x:1MB:soon", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := parseRetention(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseRetention(%q) error = %v, wantErr %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("parseRetention(%q) = %+v, want %+v", tc.in, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("parseRetention(%q)[%d] = %+v, want %+v", tc.in, i, got[i], tc.want[i])
+			}
+		}
+	}
+}
+
+func TestCleanupForgetsRemovedChannels(t *testing.T) {
+	st, err := OpenStore(t.TempDir(), 0, 0, retentionPolicy{pattern: "/**", maxAge: time.Nanosecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for _, ch := range []string{"/a", "/b"} {
+		if err := st.Append(ch, []byte(`{}`), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st.logFor("/a").lastSeen = time.Now().Add(-time.Hour)
+	time.Sleep(time.Millisecond)
+	st.cleanup()
+	if _, err := os.Stat(st.channelDir("/a")); !os.IsNotExist(err) {
+		t.Fatalf("expired channel directory still there: %v", err)
+	}
+	if _, ok := st.chans["/a"]; ok {
+		t.Fatal("removed channel still tracked")
+	}
+	if _, ok := st.chans["/b"]; !ok {
+		t.Fatal("channel with an open segment was forgotten")
+	}
+	if err := st.Append("/a", []byte(`{}`), 0); err != nil {
+		t.Fatal(err)
+	}
+	if segs, err := listSegments(st.channelDir("/a")); err != nil || len(segs) != 1 {
+		t.Fatalf("append after cleanup: %v, %v", segs, err)
+	}
+}
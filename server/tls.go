@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// certPollInterval is how often the certificate files are checked for changes.
+const certPollInterval = 10 * time.Second
+
+// certReloader serves the key pair in certFile/keyFile and picks up renewed
+// files without a restart. A failed reload keeps the previous certificate.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	mod  time.Time // newest modification time of the loaded files
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload re-reads the files if either changed since the last load.
+func (cr *certReloader) reload() (bool, error) {
+	if cr.certFile == "" {
+		return false, nil
+	}
+	var mod time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	cr.mu.RLock()
+	same := cr.cert != nil && mod.Equal(cr.mod)
+	cr.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+	cr.mu.Lock()
+	cr.cert, cr.mod = &cert, mod
+	cr.mu.Unlock()
+	return true, nil
+}
+
+// watch polls the files until ctx is done.
+func (cr *certReloader) watch(ctx context.Context) {
+	t := time.NewTicker(certPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if changed, err := cr.reload(); err != nil {
+			log.Println("tls: keeping current certificate:", err)
+		} else if changed {
+			log.Printf("tls: reloaded %s", cr.certFile)
+		}
+	}
+}
+
+func (cr *certReloader) current() *tls.Certificate {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.current(), nil
+}
+
+func (cr *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return cr.current(), nil
+}
+
+// selfSignedCert makes a throwaway certificate for localhost, this host's
+// name and the host of publicURL. Browsers and peers will not trust it.
+func selfSignedCert(publicURL string) (*tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"LogHUD development"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(30 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	hosts := []string{}
+	if h, err := os.Hostname(); err == nil {
+		hosts = append(hosts, h)
+	}
+	if u, err := url.Parse(publicURL); err == nil && u.Hostname() != "" {
+		hosts = append(hosts, u.Hostname())
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "localhost" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
+
+// tlsSetup is the node's TLS configuration: the serving certificate, which
+// is also presented to peers, and the CA node certificates must chain to.
+type tlsSetup struct {
+	certs *certReloader
+	// clusterCAs, when set, is required of clients on /_cluster/* and
+	// trusted when dialling peers
+	clusterCAs *x509.CertPool
+	caPEM      []byte
+}
+
+// tlsFromEnv reads TLS_CERT_FILE/TLS_KEY_FILE or TLS_SELF_SIGNED, and
+// TLS_CLUSTER_CA for cluster mTLS. It returns nil when TLS is off.
+func tlsFromEnv(publicURL string) (*tlsSetup, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	selfSigned := boolEnv("TLS_SELF_SIGNED")
+	caFile := os.Getenv("TLS_CLUSTER_CA")
+	switch {
+	case (certFile == "") != (keyFile == ""):
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE go together")
+	case certFile != "" && selfSigned:
+		return nil, errors.New("TLS_SELF_SIGNED conflicts with TLS_CERT_FILE")
+	case certFile == "" && !selfSigned:
+		if caFile != "" {
+			return nil, errors.New("TLS_CLUSTER_CA needs TLS_CERT_FILE or TLS_SELF_SIGNED")
+		}
+		return nil, nil
+	}
+	t := &tlsSetup{}
+	if selfSigned {
+		cert, err := selfSignedCert(publicURL)
+		if err != nil {
+			return nil, err
+		}
+		t.certs = &certReloader{cert: cert}
+	} else {
+		cr, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.certs = cr
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		t.clusterCAs, t.caPEM = x509.NewCertPool(), pem
+		if !t.clusterCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS_CLUSTER_CA %s: no certificates found", caFile)
+		}
+	}
+	return t, nil
+}
+
+// serverConfig asks for a client certificate only when cluster mTLS is on;
+// a presented certificate must verify, and requireClusterCert decides which
+// routes need one.
+func (t *tlsSetup) serverConfig() *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: t.certs.getCertificate}
+	if t.clusterCAs != nil {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		cfg.ClientCAs = t.clusterCAs
+	}
+	return cfg
+}
+
+// peerTransport is used for streams and joins to other nodes. With cluster
+// mTLS it presents this node's certificate and also trusts the cluster CA.
+func (t *tlsSetup) peerTransport() http.RoundTripper {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if t == nil || t.clusterCAs == nil {
+		return tr
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	roots.AppendCertsFromPEM(t.caPEM)
+	tr.TLSClientConfig = &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		RootCAs:              roots,
+		GetClientCertificate: t.certs.getClientCertificate,
+	}
+	return tr
+}
+
+// mutual reports whether cluster mTLS is configured.
+func (t *tlsSetup) mutual() bool {
+	return t != nil && t.clusterCAs != nil
+}
+
+// verifiesPeer reports whether the server certificate of an outbound
+// connection chains to the cluster CA rather than just to a public root.
+func (t *tlsSetup) verifiesPeer(cs *tls.ConnectionState) bool {
+	if !t.mutual() || cs == nil || len(cs.PeerCertificates) == 0 {
+		return false
+	}
+	inter := x509.NewCertPool()
+	for _, c := range cs.PeerCertificates[1:] {
+		inter.AddCert(c)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{Roots: t.clusterCAs, Intermediates: inter})
+	return err == nil
+}
+
+// verifiesClient reports whether an inbound request presented a client
+// certificate that chains to the cluster CA.
+func (t *tlsSetup) verifiesClient(cs *tls.ConnectionState) bool {
+	return t.mutual() && cs != nil && len(cs.VerifiedChains) > 0
+}
+
+// requireClusterCert rejects /_cluster/* requests without a verified client
+// certificate when cluster mTLS is configured.
+func (s *Server) requireClusterCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.tls.mutual() && !s.tls.verifiesClient(r.TLS) {
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for 127.0.0.1 signed by a throwaway CA.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	p := x509.NewCertPool()
+	p.AddCert(ca.cert)
+	return p
+}
+
+// issue returns a node certificate and key as PEM.
+func (ca *testCA) issue(t *testing.T, serial int64) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+}
+
+func (ca *testCA) keyPair(t *testing.T, serial int64) tls.Certificate {
+	t.Helper()
+	c, k := ca.issue(t, serial)
+	pair, err := tls.X509KeyPair(c, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	install := func(serial int64, at time.Time) {
+		c, k := ca.issue(t, serial)
+		for f, b := range map[string][]byte{certFile: c, keyFile: k} {
+			if err := os.WriteFile(f, b, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(f, at, at); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	serial := func(cr *certReloader) int64 {
+		leaf, err := x509.ParseCertificate(cr.current().Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+	start := time.Now().Add(-time.Hour)
+	install(10, start)
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := cr.reload(); changed || err != nil {
+		t.Fatalf("reload of unchanged files = %v, %v", changed, err)
+	}
+
+	install(11, start.Add(time.Minute))
+	if changed, err := cr.reload(); !changed || err != nil || serial(cr) != 11 {
+		t.Fatalf("reload after renewal = %v, %v, serial %d", changed, err, serial(cr))
+	}
+
+	// a broken or missing file keeps the certificate being served
+	if err := os.WriteFile(certFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := cr.reload(); changed || err == nil || serial(cr) != 11 {
+		t.Fatalf("reload of a broken file = %v, %v, serial %d", changed, err, serial(cr))
+	}
+	os.Remove(keyFile)
+	if _, err := cr.reload(); err == nil || serial(cr) != 11 {
+		t.Fatalf("reload of a missing file = %v, serial %d", err, serial(cr))
+	}
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Fatal("newCertReloader accepted missing files")
+	}
+}
+
+func TestRequireClusterCert(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.keyPair(t, 2)
+	setup := &tlsSetup{certs: &certReloader{cert: &serverCert}, clusterCAs: ca.pool(), caPEM: ca.pem}
+	s := &Server{tls: setup}
+	ts := httptest.NewUnstartedServer(s.requireClusterCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !setup.verifiesClient(r.TLS) {
+			t.Error("handler reached without a verified client")
+		}
+	})))
+	ts.TLS = setup.serverConfig()
+	// without SNI the config's own certificate is served
+	ts.TLS.Certificates = []tls.Certificate{serverCert}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	get := func(clientCerts ...tls.Certificate) (*http.Response, error) {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool(), Certificates: clientCerts}}}
+		resp, err := c.Get(ts.URL + "/_cluster/stream")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+	resp, err := get()
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("without a client cert: %v, %v; want 403", resp, err)
+	}
+	if !setup.verifiesPeer(resp.TLS) {
+		t.Fatal("server certificate from the cluster CA not verified")
+	}
+	if resp, err = get(ca.keyPair(t, 3)); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("with a cluster cert: %v, %v; want 200", resp, err)
+	}
+	other := newTestCA(t)
+	if _, err = get(other.keyPair(t, 4)); err == nil {
+		t.Fatal("client cert from another CA accepted")
+	}
+
+	// a server outside the cluster CA is not trusted with key material
+	self, _ := selfSignedCert("")
+	cs := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{mustParse(t, self.Certificate[0])}}
+	if setup.verifiesPeer(cs) || setup.verifiesPeer(nil) {
+		t.Fatal("peer outside the cluster CA verified")
+	}
+	if setup.verifiesClient(&tls.ConnectionState{}) || setup.verifiesClient(nil) {
+		t.Fatal("client without a verified chain verified")
+	}
+
+	// without cluster mTLS nothing is required and nothing is verified
+	var plain *tlsSetup
+	open := &Server{tls: plain}
+	rec := httptest.NewRecorder()
+	open.requireClusterCert(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(rec, httptest.NewRequest("GET", "/_cluster/stream", nil))
+	if rec.Code != http.StatusOK || plain.verifiesPeer(resp.TLS) || plain.verifiesClient(resp.TLS) {
+		t.Fatalf("without mTLS: status %d", rec.Code)
+	}
+}
+
+func mustParse(t *testing.T, der []byte) *x509.Certificate {
+	t.Helper()
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
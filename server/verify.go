@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// verifyEnvelope checks a pre-enveloped message the way injectMeta signed it:
+// the HMAC over the message with _meta minus hmac, under the key for
+// _meta.keyVersion, plus the channel and a ts within s.envelopeWindow of now.
+func (s *Server) verifyEnvelope(channel string, raw []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	// numbers keep their literal form so re-encoding reproduces the signed bytes
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return &ingestError{http.StatusBadRequest, "invalid envelope"}
+	}
+	meta, ok := doc["_meta"].(map[string]any)
+	if !ok {
+		return &ingestError{http.StatusBadRequest, "invalid envelope: _meta must be an object"}
+	}
+	mac, _ := meta["hmac"].(string)
+	sum, err := base64.StdEncoding.DecodeString(mac)
+	if mac == "" || err != nil {
+		return &ingestError{http.StatusBadRequest, "invalid envelope: missing hmac"}
+	}
+	if ch, _ := meta["channel"].(string); ch != channel {
+		return &ingestError{http.StatusForbidden, "envelope channel does not match"}
+	}
+	ver, err := metaInt(meta["keyVersion"])
+	if err != nil {
+		return &ingestError{http.StatusBadRequest, "invalid envelope: keyVersion"}
+	}
+	key := s.verifyKey(int(ver))
+	if key == nil {
+		return &ingestError{http.StatusForbidden, "unknown envelope keyVersion"}
+	}
+	ts, _ := meta["ts"].(string)
+	at, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return &ingestError{http.StatusBadRequest, "invalid envelope: ts"}
+	}
+	if d := time.Since(at); s.envelopeWindow > 0 && (d > s.envelopeWindow || d < -s.envelopeWindow) {
+		return &ingestError{http.StatusForbidden, "envelope outside replay window"}
+	}
+	delete(meta, "hmac")
+	signed, err := json.Marshal(doc)
+	if err != nil {
+		return &ingestError{http.StatusBadRequest, "invalid envelope"}
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(signed)
+	if !hmac.Equal(h.Sum(nil), sum) {
+		return &ingestError{http.StatusForbidden, "envelope signature invalid"}
+	}
+	return nil
+}
+
+func metaInt(v any) (int64, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, strconv.ErrSyntax
+	}
+	return n.Int64()
+}
+
+// verifyKey returns the key envelopes signed with version ver are checked
+// against, or nil once that version has expired.
+func (s *Server) verifyKey(ver int) []byte {
+	return s.keys.lookup(ver)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVerifyEnvelopeRoundTrip(t *testing.T) {
+	s := &Server{keys: newKeyring(1, []byte("test-key")), nodeID: "n1", envelopeWindow: 5 * time.Minute}
+	cases := []struct {
+		name string
+		raw  string
+	}{
+		{"plain", `{"message":"hi","level":"info"}`},
+		{"floats", `{"a":1.5,"b":1.0,"c":-0.000001,"d":1e300,"e":6.02214076e23}`},
+		{"large integers", `{"big":12345678901234567890,"max":9223372036854775807,"neg":-9007199254740993}`},
+		{"html characters", `{"message":"<a href=\"x\">&amp;</a>","u":"  "}`},
+		{"nested", `{"ctx":{"user":{"id":7,"tags":["a","<b>"]}},"list":[1,2.5,null,true]}`},
+		{"string scalar", `"just text"`},
+		{"number scalar", `42.0`},
+		{"array scalar", `[1,"two",{"three":3}]`},
+		{"null scalar", `null`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			env, err := s.injectMeta("/logs/app", wrapMessage(json.RawMessage(tc.raw)))
+			if err != nil {
+				t.Fatalf("injectMeta: %v", err)
+			}
+			if err := s.verifyEnvelope("/logs/app", env); err != nil {
+				t.Fatalf("verifyEnvelope(%s): %v", env, err)
+			}
+			if err := s.verifyEnvelope("/logs/other", env); err == nil {
+				t.Fatal("envelope verified on another channel")
+			}
+		})
+	}
+}
+
+func TestVerifyEnvelopeRejectsTampering(t *testing.T) {
+	s := &Server{keys: newKeyring(1, []byte("test-key")), nodeID: "n1", envelopeWindow: 5 * time.Minute}
+	env, err := s.injectMeta("/logs/app", json.RawMessage(`{"message":"hi","n":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(env, &doc); err != nil {
+		t.Fatal(err)
+	}
+	doc["n"] = 2
+	tampered, _ := json.Marshal(doc)
+	if err := s.verifyEnvelope("/logs/app", tampered); err == nil {
+		t.Fatal("tampered envelope verified")
+	}
+	other := &Server{keys: newKeyring(1, []byte("other-key")), envelopeWindow: 5 * time.Minute}
+	if err := other.verifyEnvelope("/logs/app", env); err == nil {
+		t.Fatal("envelope verified under a different key")
+	}
+}
+
+func TestVerifyEnvelopeRejects(t *testing.T) {
+	key := []byte("test-key")
+	s := &Server{keys: newKeyring(1, key), nodeID: "n1", envelopeWindow: 5 * time.Minute}
+	// envelope signs a message whose _meta is changed by mod, so only the
+	// field under test is wrong
+	envelope := func(signKey []byte, mod func(meta map[string]any)) []byte {
+		raw, err := s.injectMeta("/logs/app", json.RawMessage(`{"message":"hi"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc map[string]any
+		_ = json.Unmarshal(raw, &doc)
+		meta := doc["_meta"].(map[string]any)
+		delete(meta, "hmac")
+		mod(meta)
+		signed, _ := json.Marshal(doc)
+		h := hmac.New(sha256.New, signKey)
+		h.Write(signed)
+		if _, ok := meta["hmac"]; !ok {
+			meta["hmac"] = base64.StdEncoding.EncodeToString(h.Sum(nil))
+		}
+		out, _ := json.Marshal(doc)
+		return out
+	}
+	at := func(d time.Duration) func(map[string]any) {
+		return func(meta map[string]any) { meta["ts"] = time.Now().Add(d).UTC().Format(time.RFC3339Nano) }
+	}
+	cases := []struct {
+		name   string
+		env    []byte
+		status int
+	}{
+		{"valid", envelope(key, func(map[string]any) {}), 0},
+		{"ts inside window", envelope(key, at(-4*time.Minute)), 0},
+		{"ts before window", envelope(key, at(-6*time.Minute)), http.StatusForbidden},
+		{"ts after window", envelope(key, at(6*time.Minute)), http.StatusForbidden},
+		{"ts not RFC3339", envelope(key, func(m map[string]any) { m["ts"] = "yesterday" }), http.StatusBadRequest},
+		{"unknown keyVersion", envelope(key, func(m map[string]any) { m["keyVersion"] = 7 }), http.StatusForbidden},
+		{"keyVersion not a number", envelope(key, func(m map[string]any) { m["keyVersion"] = "1" }), http.StatusBadRequest},
+		{"missing hmac", envelope(key, func(m map[string]any) { m["hmac"] = nil }), http.StatusBadRequest},
+		{"empty hmac", envelope(key, func(m map[string]any) { m["hmac"] = "" }), http.StatusBadRequest},
+		{"hmac not base64", envelope(key, func(m map[string]any) { m["hmac"] = "not base64!" }), http.StatusBadRequest},
+		{"hmac under another key", envelope([]byte("other"), func(map[string]any) {}), http.StatusForbidden},
+		{"other channel", envelope(key, func(m map[string]any) { m["channel"] = "/logs/other" }), http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := s.verifyEnvelope("/logs/app", tc.env)
+			if tc.status == 0 {
+				if err != nil {
+					t.Fatalf("verifyEnvelope: %v", err)
+				}
+				return
+			}
+			if err == nil || errorStatus(err) != tc.status {
+				t.Fatalf("verifyEnvelope = %v (status %d), want status %d", err, errorStatus(err), tc.status)
+			}
+		})
+	}
+
+	// with the window off any ts is accepted
+	open := &Server{keys: s.keys, nodeID: "n1"}
+	if err := open.verifyEnvelope("/logs/app", envelope(key, at(-48*time.Hour))); err != nil {
+		t.Fatalf("window 0 refused an old envelope: %v", err)
+	}
+
+	// a retired version verifies until it expires
+	old := envelope(key, func(map[string]any) {})
+	v2, _ := s.keys.rotate()
+	s.keys.activate(v2, time.Hour)
+	if err := s.verifyEnvelope("/logs/app", old); err != nil {
+		t.Fatalf("retired key within grace: %v", err)
+	}
+	s.keys.setExpiry(1, time.Now().Add(-time.Second))
+	if err := s.verifyEnvelope("/logs/app", old); err == nil || errorStatus(err) != http.StatusForbidden {
+		t.Fatalf("expired keyVersion: %v, want 403", err)
+	}
+}